@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 
 	"maunium.net/go/mautrix"
@@ -12,9 +14,13 @@ import (
 )
 
 type ReqDeleteRoom struct {
-	RoomID     id.RoomID `json:"-"`
-	Purge      bool      `json:"purge"`
-	ForcePurge bool      `json:"force_purge"`
+	RoomID        id.RoomID `json:"-"`
+	Purge         bool      `json:"purge"`
+	ForcePurge    bool      `json:"force_purge"`
+	Block         bool      `json:"block"`
+	NewRoomUserID id.UserID `json:"new_room_user_id,omitempty"`
+	RoomName      string    `json:"room_name,omitempty"`
+	Message       string    `json:"message,omitempty"`
 }
 
 type RespDeleteRoom struct {
@@ -34,7 +40,7 @@ var fakeDeleteResponse = RespDeleteRoom{
 func adminDeleteRoom(ctx context.Context, req ReqDeleteRoom) (*RespDeleteRoom, error) {
 	var resp RespDeleteRoom
 	var err error
-	if cfg.DryRun {
+	if isDryRunContext(ctx) {
 		select {
 		case <-time.After(time.Duration(rand.Float64() * 5 * float64(time.Second))):
 			resp = fakeDeleteResponse
@@ -75,6 +81,27 @@ func adminListRoomMembers(ctx context.Context, roomID id.RoomID) ([]id.UserID, e
 	return resp.Members, nil
 }
 
+type RespListUserRooms struct {
+	JoinedRooms []id.RoomID `json:"joined_rooms"`
+	Total       int         `json:"total"`
+}
+
+// https://matrix-org.github.io/synapse/latest/admin_api/user_admin_api.html#list-room-memberships-of-a-user
+func adminListUserRooms(ctx context.Context, userID id.UserID) ([]id.RoomID, error) {
+	url := adminClient.BuildBaseURL("_synapse", "admin", "v1", "users", userID, "joined_rooms")
+	var resp RespListUserRooms
+	_, err := adminClient.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          url,
+		ResponseJSON: &resp,
+		Context:      ctx,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.JoinedRooms, nil
+}
+
 type ReqAdminLogin struct {
 	ValidUntilMS int64     `json:"valid_until_ms"`
 	UserID       id.UserID `json:"-"`
@@ -97,3 +124,175 @@ func adminLogin(ctx context.Context, req ReqAdminLogin) (*RespAdminLogin, error)
 	})
 	return &resp, err
 }
+
+// https://matrix-org.github.io/synapse/latest/admin_api/rooms.html#room-details-api
+func adminGetRoomDetails(ctx context.Context, roomID id.RoomID) (json.RawMessage, error) {
+	url := adminClient.BuildBaseURL("_synapse", "admin", "v1", "rooms", roomID)
+	var resp json.RawMessage
+	_, err := adminClient.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          url,
+		ResponseJSON: &resp,
+		Context:      ctx,
+	})
+	return resp, err
+}
+
+type RespRoomState struct {
+	State []json.RawMessage `json:"state"`
+}
+
+// https://matrix-org.github.io/synapse/latest/admin_api/rooms.html#room-state-api
+func adminGetRoomState(ctx context.Context, roomID id.RoomID) ([]json.RawMessage, error) {
+	url := adminClient.BuildBaseURL("_synapse", "admin", "v1", "rooms", roomID, "state")
+	var resp RespRoomState
+	_, err := adminClient.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          url,
+		ResponseJSON: &resp,
+		Context:      ctx,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.State, nil
+}
+
+type ReqBlockRoom struct {
+	RoomID id.RoomID `json:"-"`
+	Block  bool      `json:"block"`
+}
+
+// https://matrix-org.github.io/synapse/latest/admin_api/rooms.html#block-room-api
+func adminBlockRoom(ctx context.Context, req ReqBlockRoom) error {
+	url := adminClient.BuildBaseURL("_synapse", "admin", "v1", "rooms", req.RoomID, "block")
+	_, err := adminClient.MakeFullRequest(mautrix.FullRequest{
+		Method:      http.MethodPut,
+		URL:         url,
+		RequestJSON: &req,
+		Context:     ctx,
+	})
+	return err
+}
+
+type ReqRoomDirectoryVisibility struct {
+	Visibility string `json:"visibility"`
+}
+
+// https://spec.matrix.org/v1.2/client-server-api/#put_matrixclientv3directorylistroomroomid
+func adminRemoveFromDirectory(ctx context.Context, roomID id.RoomID) error {
+	url := adminClient.BuildURL("directory", "list", "room", roomID)
+	_, err := adminClient.MakeFullRequest(mautrix.FullRequest{
+		Method:      http.MethodPut,
+		URL:         url,
+		RequestJSON: &ReqRoomDirectoryVisibility{Visibility: "private"},
+		Context:     ctx,
+	})
+	return err
+}
+
+type AdminUser struct {
+	Name        id.UserID `json:"name"`
+	Deactivated bool      `json:"deactivated"`
+}
+
+type RespListUsers struct {
+	Users []AdminUser `json:"users"`
+	// NextToken is a string in new Synapse versions and a number in old ones.
+	NextToken interface{} `json:"next_token"`
+	Total     int         `json:"total"`
+}
+
+// https://matrix-org.github.io/synapse/latest/admin_api/user_admin_api.html#list-accounts
+func adminListUsers(ctx context.Context, name, from string, deactivated bool) (*RespListUsers, error) {
+	query := map[string]string{
+		"name":        name,
+		"guests":      "false",
+		"deactivated": strconv.FormatBool(deactivated),
+		"limit":       "100",
+	}
+	if len(from) > 0 {
+		query["from"] = from
+	}
+	url := adminClient.BuildBaseURLWithQuery(mautrix.URLPath{"_synapse", "admin", "v2", "users"}, query)
+	var resp RespListUsers
+	_, err := adminClient.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          url,
+		ResponseJSON: &resp,
+		Context:      ctx,
+	})
+	return &resp, err
+}
+
+type ReqDeactivateUser struct {
+	UserID id.UserID `json:"-"`
+	Erase  bool      `json:"erase"`
+}
+
+// https://matrix-org.github.io/synapse/latest/admin_api/user_admin_api.html#deactivate-account
+func adminDeactivateUser(ctx context.Context, req ReqDeactivateUser) error {
+	url := adminClient.BuildBaseURL("_synapse", "admin", "v1", "deactivate", req.UserID)
+	_, err := adminClient.MakeFullRequest(mautrix.FullRequest{
+		Method:      http.MethodPost,
+		URL:         url,
+		RequestJSON: &req,
+		Context:     ctx,
+	})
+	return err
+}
+
+type UserMedia struct {
+	MediaID     string `json:"media_id"`
+	MediaLength int64  `json:"media_length"`
+	CreatedTS   int64  `json:"created_ts"`
+}
+
+type RespListUserMedia struct {
+	Media     []UserMedia `json:"media"`
+	NextToken *int        `json:"next_token"`
+	Total     int         `json:"total"`
+}
+
+type RespDeleteUserMedia struct {
+	DeletedMedia []string `json:"deleted_media"`
+	Total        int      `json:"total"`
+}
+
+// userMediaQuery returns the query parameters for listing or deleting the oldest media of a user.
+func userMediaQuery(from, limit int) map[string]string {
+	return map[string]string{
+		"from":     strconv.Itoa(from),
+		"limit":    strconv.Itoa(limit),
+		"order_by": "created_ts",
+		"dir":      "f",
+	}
+}
+
+// https://matrix-org.github.io/synapse/latest/admin_api/user_admin_api.html#list-media-uploaded-by-a-user
+func adminListUserMedia(ctx context.Context, userID id.UserID, from, limit int) (*RespListUserMedia, error) {
+	url := adminClient.BuildBaseURLWithQuery(mautrix.URLPath{"_synapse", "admin", "v1", "users", userID, "media"}, userMediaQuery(from, limit))
+	var resp RespListUserMedia
+	_, err := adminClient.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          url,
+		ResponseJSON: &resp,
+		Context:      ctx,
+	})
+	return &resp, err
+}
+
+// adminDeleteUserMedia deletes the given number of the oldest media uploaded by the user.
+//
+// https://matrix-org.github.io/synapse/latest/admin_api/user_admin_api.html#delete-media-uploaded-by-a-user
+func adminDeleteUserMedia(ctx context.Context, userID id.UserID, limit int) (*RespDeleteUserMedia, error) {
+	url := adminClient.BuildBaseURLWithQuery(mautrix.URLPath{"_synapse", "admin", "v1", "users", userID, "media"}, userMediaQuery(0, limit))
+	var resp RespDeleteUserMedia
+	_, err := adminClient.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodDelete,
+		URL:          url,
+		ResponseJSON: &resp,
+		Context:      ctx,
+	})
+	return &resp, err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// AdminScope is a permission that an admin API key can have.
+type AdminScope string
+
+const (
+	// ScopeQueueRead allows reading the audit log and the status endpoint.
+	ScopeQueueRead AdminScope = "queue:read"
+	// ScopeQueueWrite allows removing rooms from the queues with the restore and cancel endpoints.
+	ScopeQueueWrite AdminScope = "queue:write"
+	// ScopeRoomsDelete allows queuing any room for deletion with the admin_clean_rooms endpoint.
+	ScopeRoomsDelete AdminScope = "rooms:delete"
+	// ScopePause allows pausing and resuming the delete queue.
+	ScopePause AdminScope = "pause"
+	// ScopeUsersDeactivate allows deactivating the ghost users of a bridge.
+	ScopeUsersDeactivate AdminScope = "users:deactivate"
+)
+
+var allAdminScopes = []AdminScope{ScopeQueueRead, ScopeQueueWrite, ScopeRoomsDelete, ScopePause, ScopeUsersDeactivate}
+
+// AdminAPIKey is a key for the yeetserv admin API. Only the SHA-256 hash of the key is stored.
+type AdminAPIKey struct {
+	Name   string       `json:"name"`
+	Hash   string       `json:"hash"`
+	Scopes []AdminScope `json:"scopes"`
+
+	hash []byte
+}
+
+// legacyAdminKey is used for requests with ADMIN_ACCESS_TOKEN when ADMIN_API_KEYS is not set.
+var legacyAdminKey = &AdminAPIKey{Name: "synapse_admin_token", Scopes: allAdminScopes}
+
+// HasScope returns true if the key has the given scope.
+func (key *AdminAPIKey) HasScope(scope AdminScope) bool {
+	for _, keyScope := range key.Scopes {
+		if keyScope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAdminAPIKeys parses the JSON list of admin API keys.
+func parseAdminAPIKeys(val string) ([]*AdminAPIKey, error) {
+	if len(strings.TrimSpace(val)) == 0 {
+		return nil, nil
+	}
+	var keys []*AdminAPIKey
+	if err := json.Unmarshal([]byte(val), &keys); err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(keys))
+	for i, key := range keys {
+		if len(key.Name) == 0 {
+			return nil, fmt.Errorf("key #%d doesn't have a name", i+1)
+		} else if _, exists := names[key.Name]; exists {
+			return nil, fmt.Errorf("duplicate key name %q", key.Name)
+		}
+		names[key.Name] = struct{}{}
+		var err error
+		key.hash, err = hex.DecodeString(strings.TrimPrefix(key.Hash, "sha256:"))
+		if err != nil || len(key.hash) != sha256.Size {
+			return nil, fmt.Errorf("hash of key %q is not a hex-encoded SHA-256 hash", key.Name)
+		}
+		for _, scope := range key.Scopes {
+			known := false
+			for _, knownScope := range allAdminScopes {
+				known = known || scope == knownScope
+			}
+			if !known {
+				return nil, fmt.Errorf("unknown scope %q in key %q", scope, key.Name)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func getAdminAPIKeys() []*AdminAPIKey {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.AdminAPIKeys
+}
+
+// findAdminAPIKey returns the admin API key matching the given token, or nil if there isn't one.
+//
+// The hash of the token is compared to every key in constant time.
+// If no keys are configured, ADMIN_ACCESS_TOKEN is accepted with all scopes.
+func findAdminAPIKey(token string) *AdminAPIKey {
+	keys := getAdminAPIKeys()
+	if len(keys) == 0 {
+		if len(cfg.AdminAccessToken) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminAccessToken)) == 1 {
+			return legacyAdminKey
+		}
+		return nil
+	}
+	tokenHash := sha256.Sum256([]byte(token))
+	var found *AdminAPIKey
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare(tokenHash[:], key.hash) == 1 {
+			found = key
+		}
+	}
+	return found
+}
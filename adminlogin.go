@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
-	log "maunium.net/go/maulogger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 )
@@ -15,6 +17,9 @@ type adminLoginSession struct {
 	*mautrix.Client
 	sync.Mutex
 	ValidUntil time.Time
+
+	// removed is set when the janitor has removed the session from the sessions map.
+	removed bool
 }
 
 // AdminLoginLifetime specifies how long user access tokens created through the admin API should be valid.
@@ -23,12 +28,24 @@ const AdminLoginLifetime = 2 * time.Hour
 // AdminLoginMinTimeLeft specifies how long an access token must have left to live before a new access token is created.
 const AdminLoginMinTimeLeft = 10 * time.Minute
 
+// adminLoginJanitorInterval specifies how often expiring sessions are logged out and removed from the sessions map.
+const adminLoginJanitorInterval = 1 * time.Minute
+
 // sessionsLock is the mutex used to lock reading/writing the sessions map.
 var sessionsLock sync.Mutex
 
 // sessions contains active user access tokens.
 var sessions = make(map[id.UserID]*adminLoginSession)
 
+var adminLoginLog = newSubsystemLogger(SubsystemMain, "AdminLogin")
+
+var promAdminLoginSessionsGauge = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "yeetserv_admin_login_sessions",
+		Help: "Current number of user access tokens created through the admin API that haven't been logged out",
+	},
+)
+
 func getAdminLoginSession(userID id.UserID) *adminLoginSession {
 	sessionsLock.Lock()
 	sess, ok := sessions[userID]
@@ -40,20 +57,64 @@ func getAdminLoginSession(userID id.UserID) *adminLoginSession {
 	return sess
 }
 
+// lockAdminLoginSession returns the locked session of the given user.
+//
+// If the janitor removed the session while waiting for the lock, a new session is used instead.
+func lockAdminLoginSession(userID id.UserID) *adminLoginSession {
+	for {
+		sess := getAdminLoginSession(userID)
+		sess.Lock()
+		if !sess.removed {
+			return sess
+		}
+		sess.Unlock()
+	}
+}
+
+// takeClient removes the client from the session and returns it. The session must be locked.
+func (sess *adminLoginSession) takeClient() *mautrix.Client {
+	client := sess.Client
+	if client != nil {
+		sess.Client = nil
+		sess.ValidUntil = time.Time{}
+		promAdminLoginSessionsGauge.Dec()
+	}
+	return client
+}
+
+// isExpiring returns true if the session doesn't have a token that is valid for long enough to be reused.
+// The session must be locked.
+func (sess *adminLoginSession) isExpiring() bool {
+	return sess.Client == nil || !sess.ValidUntil.After(time.Now().Add(AdminLoginMinTimeLeft))
+}
+
+// logoutClient logs out the access token of the given client, which also removes its device.
+func logoutClient(ctx context.Context, client *mautrix.Client) error {
+	_, err := client.MakeFullRequest(mautrix.FullRequest{
+		Method:  http.MethodPost,
+		URL:     client.BuildURL("logout"),
+		Context: ctx,
+	})
+	return err
+}
+
 // AdminLogin gets an access token for the given user using the admin API.
 //
 // If there's an existing valid access token, that token is returned.
 // Otherwise, a new token is created and cached for future use.
 func AdminLogin(ctx context.Context, userID id.UserID) (client *mautrix.Client, err error) {
-	reqLog := ctx.Value(logContextKey).(log.Logger)
+	reqLog := logFromContext(ctx)
 
-	sess := getAdminLoginSession(userID)
-	sess.Lock()
+	sess := lockAdminLoginSession(userID)
 	defer sess.Unlock()
 
-	if sess.Client != nil && sess.ValidUntil.After(time.Now().Add(AdminLoginMinTimeLeft)) {
+	if !sess.isExpiring() {
 		reqLog.Debugfln("Using existing access token for %s (valid until %s)", userID, sess.ValidUntil)
 		return sess.Client, nil
+	} else if oldClient := sess.takeClient(); oldClient != nil {
+		if logoutErr := logoutClient(ctx, oldClient); logoutErr != nil {
+			reqLog.Warnfln("Failed to log out expiring access token of %s: %v", userID, logoutErr)
+		}
 	}
 
 	validUntil := time.Now().Add(AdminLoginLifetime)
@@ -67,8 +128,96 @@ func AdminLogin(ctx context.Context, userID id.UserID) (client *mautrix.Client,
 	} else if client, err = mautrix.NewClient(cfg.SynapseURL, userID, resp.AccessToken); err != nil {
 		err = fmt.Errorf("failed to create mautrix client: %w", err)
 	} else {
+		instrumentClient(client)
 		sess.Client = client
 		sess.ValidUntil = validUntil
+		promAdminLoginSessionsGauge.Inc()
 	}
 	return
 }
+
+// LogoutAdminLogin logs out the access token of the given user if there is one.
+func LogoutAdminLogin(ctx context.Context, userID id.UserID) error {
+	sessionsLock.Lock()
+	sess, ok := sessions[userID]
+	sessionsLock.Unlock()
+	if !ok {
+		return nil
+	}
+	sess.Lock()
+	client := sess.takeClient()
+	sess.Unlock()
+	if client == nil {
+		return nil
+	}
+	logFromContext(ctx).Debugfln("Logging out access token of %s", userID)
+	return logoutClient(ctx, client)
+}
+
+// LogoutAllAdminLogins logs out all access tokens and empties the sessions map. This is called on shutdown.
+func LogoutAllAdminLogins(ctx context.Context) {
+	sessionsLock.Lock()
+	allSessions := sessions
+	sessions = make(map[id.UserID]*adminLoginSession)
+	sessionsLock.Unlock()
+	loggedOut := 0
+	for userID, sess := range allSessions {
+		sess.Lock()
+		sess.removed = true
+		client := sess.takeClient()
+		sess.Unlock()
+		if client == nil {
+			continue
+		} else if err := logoutClient(ctx, client); err != nil {
+			adminLoginLog.Warnfln("Failed to log out access token of %s: %v", userID, err)
+		} else {
+			loggedOut++
+		}
+	}
+	adminLoginLog.Debugfln("Logged out %d access tokens", loggedOut)
+}
+
+// evictExpiringAdminLogins removes sessions that are empty or can't be reused anymore from the sessions map
+// and logs out their access tokens while they're still valid.
+//
+// Sessions that are currently locked are skipped.
+func evictExpiringAdminLogins(ctx context.Context) {
+	evicted := make(map[id.UserID]*mautrix.Client)
+	sessionsLock.Lock()
+	for userID, sess := range sessions {
+		if !sess.TryLock() {
+			continue
+		}
+		if sess.isExpiring() {
+			sess.removed = true
+			evicted[userID] = sess.takeClient()
+			delete(sessions, userID)
+		}
+		sess.Unlock()
+	}
+	sessionsLock.Unlock()
+	for userID, client := range evicted {
+		if client == nil {
+			continue
+		}
+		adminLoginLog.Debugfln("Logging out expiring access token of %s", userID)
+		if err := logoutClient(ctx, client); err != nil {
+			adminLoginLog.Warnfln("Failed to log out expiring access token of %s: %v", userID, err)
+		}
+	}
+}
+
+func loopAdminLoginJanitor(ctx context.Context, wg *sync.WaitGroup) {
+	defer func() {
+		adminLoginLog.Infoln("Admin login janitor exiting")
+		wg.Done()
+	}()
+	for {
+		select {
+		case <-time.After(adminLoginJanitorInterval):
+			evictExpiringAdminLogins(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
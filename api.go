@@ -4,19 +4,27 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
-	log "maunium.net/go/maulogger/v2"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/id"
 )
 
 var globalReqID int32
-var logContextKey = "com.beeper.maulogger"
+
+// requestInfo contains the request ID and client IP of an API request.
+type requestInfo struct {
+	ID       int32
+	ClientIP string
+}
 
 var (
 	errNotJSON = appservice.Error{
@@ -44,6 +52,11 @@ var (
 		ErrorCode:  "M_UNKNOWN_TOKEN",
 		Message:    "Failed to check token validity",
 	}
+	errMissingScope = appservice.Error{
+		HTTPStatus: http.StatusForbidden,
+		ErrorCode:  "M_FORBIDDEN",
+		Message:    "The API key doesn't have the scope required for this endpoint",
+	}
 	errCleanFailed = appservice.Error{
 		HTTPStatus: http.StatusInternalServerError,
 		ErrorCode:  "M_UNKNOWN",
@@ -54,15 +67,90 @@ var (
 		ErrorCode:  "M_FORBIDDEN",
 		Message:    "You are not allowed to use this microservice to clean up rooms",
 	}
+	errBadQuery = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_INVALID_PARAM",
+		Message:    "Query parameters are invalid",
+	}
+	errBadSchedule = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_INVALID_PARAM",
+		Message:    "delete_after must be a non-negative duration and can't be used together with delete_at",
+	}
+	errBadOwner = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_INVALID_PARAM",
+		Message:    "owner must be a bridge bot, and is required when check_rules or leave_first is set",
+	}
+	errAdminOnlyDeleteOptions = appservice.Error{
+		HTTPStatus: http.StatusForbidden,
+		ErrorCode:  "M_FORBIDDEN",
+		Message:    "new_room_user_id, room_name and message can only be set through the admin API",
+	}
+	errRulesUnavailable = appservice.Error{
+		HTTPStatus: http.StatusBadRequest,
+		ErrorCode:  "M_INVALID_PARAM",
+		Message:    "Checking the rules as a bridge bot requires ASMUX_AS_TOKEN to be configured",
+	}
+	errCancelFailed = appservice.Error{
+		HTTPStatus: http.StatusInternalServerError,
+		ErrorCode:  "M_UNKNOWN",
+		Message:    "An internal error occurred while cancelling the cleanup",
+	}
+	errPauseFailed = appservice.Error{
+		HTTPStatus: http.StatusInternalServerError,
+		ErrorCode:  "M_UNKNOWN",
+		Message:    "Failed to pause or resume the delete queue",
+	}
+	errGhostsFailed = appservice.Error{
+		HTTPStatus: http.StatusInternalServerError,
+		ErrorCode:  "M_UNKNOWN",
+		Message:    "An internal error occurred while checking the bridge ghosts",
+	}
+	errAuditDisabled = appservice.Error{
+		HTTPStatus: http.StatusNotFound,
+		ErrorCode:  "M_NOT_FOUND",
+		Message:    "Audit log is not enabled",
+	}
+	errAuditReadFailed = appservice.Error{
+		HTTPStatus: http.StatusInternalServerError,
+		ErrorCode:  "M_UNKNOWN",
+		Message:    "An internal error occurred while reading the audit log",
+	}
 )
 
-func prepareRequest(r *http.Request) (context.Context, log.Logger) {
+func prepareRequest(r *http.Request) (context.Context, *Logger) {
 	reqID := atomic.AddInt32(&globalReqID, 1)
-	reqLog := log.Sub("Req").Sub(clientIP(r)).Sub(strconv.Itoa(int(reqID)))
-	ctx := context.WithValue(r.Context(), logContextKey, reqLog)
+	ip := clientIP(r)
+	reqLog := apiLog.Sub(ip).Sub(strconv.Itoa(int(reqID))).With(LogFields{
+		"request_id": reqID,
+		"client_ip":  ip,
+	})
+	ctx := contextWithLog(r.Context(), reqLog)
+	ctx = context.WithValue(ctx, requestInfoContextKey, &requestInfo{ID: reqID, ClientIP: ip})
+	// Use the same dry run mode for the whole request even if the config is reloaded in the middle of it
+	ctx = contextWithDryRun(ctx, isDryRun())
 	return ctx, reqLog
 }
 
+// verifyAdminToken returns the admin API key used in the request if it has the given scope.
+func verifyAdminToken(w http.ResponseWriter, authHeader string, scope AdminScope) *AdminAPIKey {
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	if len(token) == 0 {
+		errMissingToken.Write(w)
+		return nil
+	}
+	key := findAdminAPIKey(token)
+	if key == nil {
+		errUnknownToken.Write(w)
+		return nil
+	} else if !key.HasScope(scope) {
+		errMissingScope.Write(w)
+		return nil
+	}
+	return key
+}
+
 func verifyToken(ctx context.Context, w http.ResponseWriter, authHeader string) *mautrix.Client {
 	token := strings.TrimPrefix(authHeader, "Bearer ")
 	if len(token) == 0 {
@@ -70,18 +158,23 @@ func verifyToken(ctx context.Context, w http.ResponseWriter, authHeader string)
 		return nil
 	}
 
-	reqLog := ctx.Value(logContextKey).(log.Logger)
+	reqLog := logFromContext(ctx)
 	var whoami *mautrix.RespWhoami
-	if client, err := mautrix.NewClient(cfg.AsmuxURL, "", token); err != nil {
-		reqLog.Warnfln("Failed to create client:", err)
+	client, err := mautrix.NewClient(cfg.AsmuxURL, "", token)
+	if err != nil {
+		reqLog.Warnln("Failed to create client:", err)
 		errTokenCheckFail.Write(w)
-	} else if whoami, err = client.Whoami(); errors.Is(err, mautrix.MUnknownToken) {
+		return nil
+	}
+	instrumentClient(client)
+	if whoami, err = client.Whoami(); errors.Is(err, mautrix.MUnknownToken) {
 		reqLog.Debugln("Incorrect token:", err)
 		errUnknownToken.Write(w)
 	} else if err != nil {
 		reqLog.Warnln("Unknown error checking whoami:", err)
 		errTokenCheckFail.Write(w)
 	} else if err = IsAllowedToUseService(ctx, client, whoami); err != nil {
+		observeStageError("", StageFilter, err)
 		reqLog.Debugfln("%s asked to clean rooms, but the rules rejected it: %v", client.UserID, err)
 		errCleanForbidden.Write(w)
 	} else {
@@ -95,9 +188,30 @@ func handleCleanAllRooms(w http.ResponseWriter, r *http.Request) {
 	client := verifyToken(ctx, w, r.Header.Get("Authorization"))
 	if client == nil {
 		return
+	} else if limitErr := CheckRateLimit(client.UserID); limitErr != nil {
+		reqLog.Debugfln("Rejecting clean_all request from %s: %v", client.UserID, limitErr)
+		limitErr.Write(w)
+		return
 	}
 
-	if resp, err := cleanRooms(ctx, client); err != nil {
+	var req ReqCleanAllRooms
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if _, ok := err.(*json.SyntaxError); ok {
+		w.Header().Add("Accept", "application/json")
+		errNotJSON.Write(w)
+		return
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		errBadJSON.Write(w)
+		return
+	} else if err = RegisterOwnerNotification(ctx, client, &req.NotifyOptions); err != nil {
+		reqLog.Warnfln("Failed to store notification options of %s: %v", client.UserID, err)
+	}
+
+	var limitErr *LimitExceededError
+	if resp, err := cleanRooms(ctx, client); errors.As(err, &limitErr) {
+		reqLog.Debugfln("Rejecting clean_all request from %s: %v", client.UserID, limitErr)
+		limitErr.Write(w)
+	} else if err != nil {
 		reqLog.Errorfln("Failed to clean rooms of %s: %v", client.UserID, err)
 		errCleanFailed.Write(w)
 	} else {
@@ -107,13 +221,28 @@ func handleCleanAllRooms(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type ReqCleanAllRooms struct {
+	NotifyOptions
+}
+
 type ReqQueueRooms struct {
 	RoomIDs   []id.RoomID `json:"room_ids"`
 	LeaveRoom bool        `json:"leave_room"`
+	DeleteOptions
+	ScheduleOptions
+	NotifyOptions
 }
 
 type ReqAdminCleanRooms struct {
 	RoomIDs []id.RoomID `json:"room_ids"`
+	// Owner is the bridge bot that the rooms are attributed to in metrics, the audit log and owner tracking.
+	Owner id.UserID `json:"owner,omitempty"`
+	// CheckRules makes the rooms go through the same rules as bridge requests, using Owner as the bridge bot.
+	CheckRules bool `json:"check_rules,omitempty"`
+	// LeaveFirst makes the rooms go through the leave queue instead of being pushed to the delete queue directly.
+	LeaveFirst bool `json:"leave_first,omitempty"`
+	DeleteOptions
+	ScheduleOptions
 }
 
 type RespQueueRooms struct {
@@ -127,6 +256,10 @@ func handleQueue(w http.ResponseWriter, r *http.Request) {
 	client := verifyToken(ctx, w, r.Header.Get("Authorization"))
 	if client == nil {
 		return
+	} else if limitErr := CheckRateLimit(client.UserID); limitErr != nil {
+		reqLog.Debugfln("Rejecting queue request from %s: %v", client.UserID, limitErr)
+		limitErr.Write(w)
+		return
 	}
 
 	var req ReqQueueRooms
@@ -140,27 +273,82 @@ func handleQueue(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	dueTime, err := req.ScheduleOptions.DueTime()
+	if err != nil {
+		reqLog.Debugln("Invalid schedule in queue request:", err)
+		errBadSchedule.Write(w)
+		return
+	} else if req.DeleteOptions.HasReplacementRoomOptions() {
+		reqLog.Debugfln("Rejecting queue request from %s with replacement room options", client.UserID)
+		errAdminOnlyDeleteOptions.Write(w)
+		return
+	} else if limitErr := ReserveRoomQuota(ctx, client.UserID, int64(len(req.RoomIDs))); limitErr != nil {
+		reqLog.Debugfln("Rejecting queue request from %s: %v", client.UserID, limitErr)
+		limitErr.Write(w)
+		return
+	}
+	if err = RegisterOwnerNotification(ctx, client, &req.NotifyOptions); err != nil {
+		reqLog.Warnfln("Failed to store notification options of %s: %v", client.UserID, err)
+	}
+
 	var resp RespQueueRooms
 	for _, roomID := range req.RoomIDs {
-		usersToKick, err := IsAllowedToCleanRoom(ctx, client, roomID)
+		roomCtx, span := startSpan(ctx, "queue_room", roomID, client.UserID)
+		usersToKick, decision, err := IsAllowedToCleanRoom(roomCtx, client, roomID)
+		observeStageError(client.UserID, StageFilter, err)
 		if err != nil {
-			reqLog.Debugln("Rejecting queuing of %s for deletion: %v", roomID, err)
+			reqLog.With(LogFields{"room_id": roomID, "owner": client.UserID, "stage": StageFilter}).
+				Debugfln("Rejecting queuing of %s for deletion: %v", roomID, err)
 			resp.Rejected = append(resp.Rejected, roomID)
+			WriteRequestAudit(ctx, AuditEntry{
+				Event:     AuditEventRejected,
+				RoomID:    roomID,
+				Owner:     client.UserID,
+				Requester: client.UserID.String(),
+				Decision:  err.Error(),
+			})
 		} else {
 			if req.LeaveRoom {
-				err = PushLeaveQueue(ctx, roomID, usersToKick)
+				leavingRoom := newBridgeLeavingRoom(roomCtx, client, roomID, usersToKick)
+				leavingRoom.DeleteOptions = req.DeleteOptions.OrNil()
+				leavingRoom.DueTime = dueTime
+				err = PushLeaveQueue(roomCtx, leavingRoom)
 			} else {
-				err = PushDeleteQueue(ctx, roomID)
+				err = PushDeleteQueue(roomCtx, &PendingRoom{
+					RoomID:        roomID,
+					Owner:         client.UserID,
+					DeleteOptions: req.DeleteOptions.OrNil(),
+					DueTime:       dueTime,
+				})
 			}
 
 			if err != nil {
 				resp.Failed = append(resp.Failed, roomID)
 				reqLog.Warnfln("Failed to queue %s for deletion: %v", roomID, err)
 			} else {
-				reqLog.Debugln("Queued", roomID, "for deletion (leave: %v)", req.LeaveRoom)
+				TrackOwnerRoom(ctx, client.UserID)
+				reqLog.With(LogFields{"room_id": roomID, "owner": client.UserID}).
+					Debugfln("Queued %s for deletion (leave: %t)", roomID, req.LeaveRoom)
 				resp.Queued = append(resp.Queued, roomID)
+				WriteRequestAudit(ctx, AuditEntry{
+					Event:     AuditEventQueued,
+					RoomID:    roomID,
+					Owner:     client.UserID,
+					Requester: client.UserID.String(),
+					Decision:  decision,
+				})
 			}
 		}
+		endSpan(span, err)
+	}
+	if unused := len(req.RoomIDs) - len(resp.Queued); unused > 0 {
+		if _, err = AddRoomQuota(ctx, client.UserID, -int64(unused)); err != nil {
+			reqLog.Warnfln("Failed to return %d unused rooms to the quota of %s: %v", unused, client.UserID, err)
+		}
+	}
+	if len(resp.Queued) == 0 && req.NotifyOptions.IsSet() {
+		// Nothing was queued, so the rooms won't trigger the notification
+		checkOwnerDrained(ctx, client.UserID)
 	}
 
 	w.Header().Add("Content-Type", "application/json")
@@ -176,15 +364,8 @@ func handleQueue(w http.ResponseWriter, r *http.Request) {
 
 func handleAdminCleanRooms(w http.ResponseWriter, r *http.Request) {
 	ctx, reqLog := prepareRequest(r)
-
-	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	if len(token) == 0 {
-		errMissingToken.Write(w)
-		return
-	}
-
-	if token != cfg.AdminAccessToken {
-		errUnknownToken.Write(w)
+	adminKey := verifyAdminToken(w, r.Header.Get("Authorization"), ScopeRoomsDelete)
+	if adminKey == nil {
 		return
 	}
 
@@ -199,17 +380,95 @@ func handleAdminCleanRooms(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	dueTime, err := req.ScheduleOptions.DueTime()
+	if err != nil {
+		reqLog.Debugln("Invalid schedule in admin clean request:", err)
+		errBadSchedule.Write(w)
+		return
+	}
+	var rulesClient *mautrix.Client
+	if len(req.Owner) > 0 || req.CheckRules || req.LeaveFirst {
+		if _, _, _, err = parseBridgeName(req.Owner); err != nil {
+			reqLog.Debugfln("Invalid owner %q in admin clean request: %v", req.Owner, err)
+			errBadOwner.Write(w)
+			return
+		}
+	}
+	if req.CheckRules {
+		if len(cfg.AsmuxASToken) == 0 {
+			errRulesUnavailable.Write(w)
+			return
+		}
+		rulesClient = bridgeBotClient(req.Owner)
+	}
+
 	var resp RespQueueRooms
 	for _, roomID := range req.RoomIDs {
-		err = PushDeleteQueue(ctx, roomID)
+		roomCtx, span := startSpan(ctx, "queue_room", roomID, req.Owner)
+		var usersToKick []id.UserID
+		decision := "rules skipped by admin API"
+		if rulesClient != nil {
+			usersToKick, decision, err = IsAllowedToCleanRoom(roomCtx, rulesClient, roomID)
+			observeStageError(req.Owner, StageFilter, err)
+			if err != nil {
+				reqLog.With(LogFields{"room_id": roomID, "owner": req.Owner, "stage": StageFilter}).
+					Debugfln("Rejecting queuing of %s for deletion: %v", roomID, err)
+				resp.Rejected = append(resp.Rejected, roomID)
+				WriteRequestAudit(ctx, AuditEntry{
+					Event:     AuditEventRejected,
+					RoomID:    roomID,
+					Owner:     req.Owner,
+					Requester: "admin",
+					AdminKey:  adminKey.Name,
+					Decision:  err.Error(),
+				})
+				endSpan(span, err)
+				continue
+			}
+		} else if req.LeaveFirst {
+			// The rules find the bridge user to kick, so find it separately when they're skipped
+			if usersToKick, err = findBridgeUsersInRoom(roomCtx, req.Owner, roomID); err != nil {
+				reqLog.Warnfln("Failed to find bridge user in %s: %v", roomID, err)
+				resp.Failed = append(resp.Failed, roomID)
+				endSpan(span, err)
+				continue
+			}
+		}
+
+		if req.LeaveFirst {
+			err = PushLeaveQueue(roomCtx, &LeavingRoom{
+				RoomID:        roomID,
+				Owner:         req.Owner,
+				Kick:          usersToKick,
+				DeleteOptions: req.DeleteOptions.OrNil(),
+				DueTime:       dueTime,
+			})
+		} else {
+			err = PushDeleteQueue(roomCtx, &PendingRoom{
+				RoomID:        roomID,
+				Owner:         req.Owner,
+				DeleteOptions: req.DeleteOptions.OrNil(),
+				DueTime:       dueTime,
+			})
+		}
 
 		if err != nil {
 			resp.Failed = append(resp.Failed, roomID)
 			reqLog.Warnfln("Failed to queue %s for deletion: %v", roomID, err)
 		} else {
-			reqLog.Debugln("Queued", roomID, "for deletion")
+			TrackOwnerRoom(ctx, req.Owner)
+			reqLog.Debugfln("Queued %s for deletion (leave: %t)", roomID, req.LeaveFirst)
 			resp.Queued = append(resp.Queued, roomID)
+			WriteRequestAudit(ctx, AuditEntry{
+				Event:     AuditEventQueued,
+				RoomID:    roomID,
+				Owner:     req.Owner,
+				Requester: "admin",
+				AdminKey:  adminKey.Name,
+				Decision:  decision,
+			})
 		}
+		endSpan(span, err)
 	}
 
 	w.Header().Add("Content-Type", "application/json")
@@ -223,6 +482,378 @@ func handleAdminCleanRooms(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(&resp)
 }
 
+func handleAdminCleanUser(w http.ResponseWriter, r *http.Request) {
+	ctx, reqLog := prepareRequest(r)
+	adminKey := verifyAdminToken(w, r.Header.Get("Authorization"), ScopeRoomsDelete)
+	if adminKey == nil {
+		return
+	}
+
+	var req ReqAdminCleanUser
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if _, ok := err.(*json.SyntaxError); ok {
+		w.Header().Add("Accept", "application/json")
+		errNotJSON.Write(w)
+		return
+	} else if err != nil || len(req.UserID) == 0 {
+		errBadJSON.Write(w)
+		return
+	} else if len(cfg.AsmuxASToken) == 0 {
+		errRulesUnavailable.Write(w)
+		return
+	}
+	dueTime, err := req.ScheduleOptions.DueTime()
+	if err != nil {
+		reqLog.Debugln("Invalid schedule in admin clean user request:", err)
+		errBadSchedule.Write(w)
+		return
+	}
+
+	reqLog.Infofln("Admin API key %s requested cleaning up all bridged rooms of %s", adminKey.Name, req.UserID)
+	resp, err := CleanUserRooms(ctx, &req, dueTime, adminKey)
+	if err != nil {
+		reqLog.Errorfln("Failed to clean up rooms of %s: %v", req.UserID, err)
+		errCleanFailed.Write(w)
+		return
+	}
+	reqLog.Infofln("Finished queuing rooms of %s: %d bridges, %d unmatched rooms, %d failed rooms",
+		req.UserID, len(resp.Bridges), len(resp.Unmatched), len(resp.Failed))
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+type ReqAdminRestoreRooms struct {
+	RoomIDs []id.RoomID `json:"room_ids"`
+}
+
+type RespAdminRestoreRooms struct {
+	Restored []id.RoomID `json:"restored"`
+	NotFound []id.RoomID `json:"not_found"`
+	Failed   []id.RoomID `json:"failed"`
+}
+
+func handleAdminRestoreRooms(w http.ResponseWriter, r *http.Request) {
+	ctx, reqLog := prepareRequest(r)
+	adminKey := verifyAdminToken(w, r.Header.Get("Authorization"), ScopeQueueWrite)
+	if adminKey == nil {
+		return
+	}
+
+	var req ReqAdminRestoreRooms
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if _, ok := err.(*json.SyntaxError); ok {
+		w.Header().Add("Accept", "application/json")
+		errNotJSON.Write(w)
+		return
+	} else if err != nil {
+		errBadJSON.Write(w)
+		return
+	}
+
+	resp := RespAdminRestoreRooms{
+		Restored: []id.RoomID{},
+		NotFound: []id.RoomID{},
+		Failed:   []id.RoomID{},
+	}
+	for _, roomID := range req.RoomIDs {
+		removed, err := RemoveFromQueues(ctx, roomID)
+		if len(removed) == 0 {
+			if err != nil {
+				reqLog.Warnfln("Failed to remove %s from the queues: %v", roomID, err)
+				resp.Failed = append(resp.Failed, roomID)
+			} else {
+				reqLog.Debugfln("%s was not found in the queues, it may have already been deleted", roomID)
+				resp.NotFound = append(resp.NotFound, roomID)
+			}
+			continue
+		}
+		entry := AuditEntry{
+			Event:     AuditEventRestored,
+			RoomID:    roomID,
+			Owner:     removed[0].Owner,
+			Requester: "admin",
+			AdminKey:  adminKey.Name,
+		}
+		for _, pendingRoom := range removed {
+			entry.Blocked = entry.Blocked || pendingRoom.Blocked
+		}
+		if err != nil {
+			reqLog.Warnfln("Failed to remove all entries of %s from the queues: %v", roomID, err)
+			resp.Failed = append(resp.Failed, roomID)
+			entry.Error = err.Error()
+		} else if !entry.Blocked {
+			reqLog.Debugfln("Removed %s from the queues, it wasn't blocked yet", roomID)
+			resp.Restored = append(resp.Restored, roomID)
+		} else if isDryRunContext(ctx) {
+			reqLog.Debugfln("Removed %s from the queues, not unblocking as we're in dry run mode", roomID)
+			resp.Restored = append(resp.Restored, roomID)
+		} else if err = adminBlockRoom(ctx, ReqBlockRoom{RoomID: roomID, Block: false}); err != nil {
+			reqLog.Warnfln("Removed %s from the queues, but failed to unblock it: %v", roomID, err)
+			resp.Failed = append(resp.Failed, roomID)
+			entry.Error = fmt.Sprintf("failed to unblock room: %v", err)
+		} else {
+			reqLog.Debugfln("Removed %s from the queues and unblocked it", roomID)
+			resp.Restored = append(resp.Restored, roomID)
+		}
+		WriteRequestAudit(ctx, entry)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+type ReqCancelCleanup struct {
+	// Owner is the bridge bot whose cleanup should be cancelled. Only used with the admin token.
+	Owner id.UserID `json:"owner"`
+}
+
+type RespCancelCleanup struct {
+	Cancelled []id.RoomID `json:"cancelled"`
+	Left      []id.RoomID `json:"left"`
+	Deleted   []id.RoomID `json:"deleted"`
+	Failed    []id.RoomID `json:"failed"`
+}
+
+func handleCancelCleanup(w http.ResponseWriter, r *http.Request) {
+	ctx, reqLog := prepareRequest(r)
+	authHeader := r.Header.Get("Authorization")
+	var owner id.UserID
+	var requester string
+	var adminKey *AdminAPIKey
+	if token := strings.TrimPrefix(authHeader, "Bearer "); len(token) > 0 {
+		adminKey = findAdminAPIKey(token)
+	}
+	if adminKey != nil {
+		if !adminKey.HasScope(ScopeQueueWrite) {
+			errMissingScope.Write(w)
+			return
+		}
+		var req ReqCancelCleanup
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if _, ok := err.(*json.SyntaxError); ok {
+			w.Header().Add("Accept", "application/json")
+			errNotJSON.Write(w)
+			return
+		} else if err != nil || len(req.Owner) == 0 {
+			errBadJSON.Write(w)
+			return
+		}
+		owner = req.Owner
+		requester = "admin"
+	} else if client := verifyToken(ctx, w, authHeader); client == nil {
+		return
+	} else {
+		owner = client.UserID
+		requester = client.UserID.String()
+	}
+	reqLog.Infoln(requester, "requested cancelling the cleanup of", owner)
+
+	ctx, job := startJob(ctx, owner, JobActionCancel)
+	defer job.finish()
+	if err := CancelActiveJobs(ctx, owner); err != nil {
+		reqLog.Errorfln("Failed to stop clean_all requests of %s: %v", owner, err)
+		errCancelFailed.Write(w)
+		return
+	}
+	leavingRooms, pendingRooms, err := RemoveOwnerFromQueues(ctx, owner)
+	if err != nil {
+		reqLog.Errorfln("Failed to remove rooms of %s from the queues: %v", owner, err)
+		errCancelFailed.Write(w)
+		return
+	}
+
+	resp := RespCancelCleanup{
+		Cancelled: []id.RoomID{},
+		Left:      []id.RoomID{},
+		Deleted:   []id.RoomID{},
+		Failed:    []id.RoomID{},
+	}
+	for _, leavingRoom := range leavingRooms {
+		resp.Cancelled = append(resp.Cancelled, leavingRoom.RoomID)
+	}
+	for _, pendingRoom := range pendingRooms {
+		resp.Cancelled = append(resp.Cancelled, pendingRoom.RoomID)
+		if pendingRoom.Left {
+			resp.Left = append(resp.Left, pendingRoom.RoomID)
+		}
+		if !pendingRoom.Blocked {
+			continue
+		} else if isDryRunContext(ctx) {
+			reqLog.Debugfln("Not unblocking %s as we're in dry run mode", pendingRoom.RoomID)
+		} else if err = adminBlockRoom(ctx, ReqBlockRoom{RoomID: pendingRoom.RoomID, Block: false}); err != nil {
+			reqLog.Warnfln("Removed %s from the queues, but failed to unblock it: %v", pendingRoom.RoomID, err)
+			resp.Failed = append(resp.Failed, pendingRoom.RoomID)
+		}
+	}
+	for _, roomID := range resp.Cancelled {
+		entry := AuditEntry{
+			Event:     AuditEventRestored,
+			RoomID:    roomID,
+			Owner:     owner,
+			Requester: requester,
+		}
+		if adminKey != nil {
+			entry.AdminKey = adminKey.Name
+		}
+		WriteRequestAudit(ctx, entry)
+	}
+	if deleted, err := GetOwnerDeletedRooms(ctx, owner); err != nil {
+		reqLog.Warnfln("Failed to get deleted rooms of %s: %v", owner, err)
+	} else {
+		resp.Deleted = append(resp.Deleted, deleted...)
+	}
+	reqLog.Infofln("Cancelled cleanup of %s: removed %d rooms from the queues (%d already left), %d already deleted",
+		owner, len(resp.Cancelled), len(resp.Left), len(resp.Deleted))
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+type RespAdminAudit struct {
+	Entries []*AuditEntry `json:"entries"`
+}
+
+func parseUnixMilliQuery(query url.Values, key string) (time.Time, error) {
+	val := query.Get(key)
+	if len(val) == 0 {
+		return time.Time{}, nil
+	}
+	ms, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)), nil
+}
+
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	_, reqLog := prepareRequest(r)
+	if verifyAdminToken(w, r.Header.Get("Authorization"), ScopeQueueRead) == nil {
+		return
+	} else if len(cfg.AuditLogPath) == 0 {
+		errAuditDisabled.Write(w)
+		return
+	}
+
+	query := r.URL.Query()
+	auditQuery := AuditQuery{
+		RoomID: id.RoomID(query.Get("room_id")),
+		Owner:  id.UserID(query.Get("owner")),
+		Limit:  1000,
+	}
+	var err error
+	if auditQuery.Since, err = parseUnixMilliQuery(query, "since"); err != nil {
+		errBadQuery.Write(w)
+		return
+	} else if auditQuery.Until, err = parseUnixMilliQuery(query, "until"); err != nil {
+		errBadQuery.Write(w)
+		return
+	} else if limitStr := query.Get("limit"); len(limitStr) > 0 {
+		if auditQuery.Limit, err = strconv.Atoi(limitStr); err != nil {
+			errBadQuery.Write(w)
+			return
+		}
+	}
+
+	entries, err := ReadAudit(auditQuery)
+	if err != nil {
+		reqLog.Errorln("Failed to read audit log:", err)
+		errAuditReadFailed.Write(w)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&RespAdminAudit{Entries: entries})
+}
+
+type ReqAdminPause struct {
+	Paused bool `json:"paused"`
+}
+
+func handleAdminPause(w http.ResponseWriter, r *http.Request) {
+	ctx, reqLog := prepareRequest(r)
+	adminKey := verifyAdminToken(w, r.Header.Get("Authorization"), ScopePause)
+	if adminKey == nil {
+		return
+	}
+
+	var req ReqAdminPause
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if _, ok := err.(*json.SyntaxError); ok {
+		w.Header().Add("Accept", "application/json")
+		errNotJSON.Write(w)
+		return
+	} else if err != nil {
+		errBadJSON.Write(w)
+		return
+	}
+
+	if err = SetDeletePaused(ctx, req.Paused); err != nil {
+		reqLog.Errorfln("Failed to set delete queue paused to %t: %v", req.Paused, err)
+		errPauseFailed.Write(w)
+		return
+	}
+	reqLog.Infofln("Delete queue paused set to %t with admin API key %s", req.Paused, adminKey.Name)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&req)
+}
+
+type ReqAdminDeactivateGhosts struct {
+	Owner  id.UserID `json:"owner"`
+	DryRun bool      `json:"dry_run"`
+}
+
+type RespAdminDeactivateGhosts struct {
+	Started bool `json:"started"`
+}
+
+func handleAdminDeactivateGhosts(w http.ResponseWriter, r *http.Request) {
+	ctx, reqLog := prepareRequest(r)
+	adminKey := verifyAdminToken(w, r.Header.Get("Authorization"), ScopeUsersDeactivate)
+	if adminKey == nil {
+		return
+	}
+
+	var req ReqAdminDeactivateGhosts
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if _, ok := err.(*json.SyntaxError); ok {
+		w.Header().Add("Accept", "application/json")
+		errNotJSON.Write(w)
+		return
+	} else if err != nil || len(req.Owner) == 0 {
+		errBadJSON.Write(w)
+		return
+	} else if _, _, _, err = parseBridgeName(req.Owner); err != nil {
+		errBadOwner.Write(w)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if req.DryRun || isDryRunContext(ctx) {
+		reqLog.Infofln("Admin API key %s requested a dry run of deactivating the ghosts of %s", adminKey.Name, req.Owner)
+		report, err := DeactivateGhosts(ctx, req.Owner, true)
+		if err != nil {
+			reqLog.Errorfln("Failed to check ghosts of %s: %v", req.Owner, err)
+			errGhostsFailed.Write(w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(report)
+		return
+	}
+	started := StartGhostDeactivation(ctx, req.Owner)
+	if started {
+		reqLog.Infofln("Admin API key %s started deactivating the ghosts of %s", adminKey.Name, req.Owner)
+	} else {
+		reqLog.Infofln("Admin API key %s requested deactivating the ghosts of %s, but it's already running", adminKey.Name, req.Owner)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(&RespAdminDeactivateGhosts{Started: started})
+}
+
 func clientIP(r *http.Request) string {
 	if cfg.TrustForwardHeader {
 		fwd := r.Header.Get("X-Forwarded-For")
@@ -16,7 +16,7 @@ func asmuxDeleteRoom(ctx context.Context, roomID id.RoomID) error {
 		return fmt.Errorf("asmux access token not set")
 	} else if cfg.AsmuxMainURL == nil {
 		return fmt.Errorf("asmux main URL not set")
-	} else if cfg.DryRun {
+	} else if isDryRunContext(ctx) {
 		time.Sleep(200 * time.Millisecond)
 		return nil
 	}
@@ -26,7 +26,7 @@ func asmuxDeleteRoom(ctx context.Context, roomID id.RoomID) error {
 		return fmt.Errorf("failed to prepare request: %w", err)
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", cfg.AsmuxAccessToken))
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to execute request: %w", err)
 	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
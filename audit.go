@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// AuditEvent is the type of a single entry in the audit log.
+type AuditEvent string
+
+const (
+	// AuditEventRejected means the rules didn't allow cleaning up the room.
+	AuditEventRejected AuditEvent = "rejected"
+	// AuditEventQueued means the room was accepted and added to the leave or delete queue.
+	AuditEventQueued AuditEvent = "queued"
+	// AuditEventLeft means the leave queue kicked users and removed aliases from the room.
+	AuditEventLeft AuditEvent = "left"
+	// AuditEventDeleted means the Synapse delete room API was called successfully.
+	AuditEventDeleted AuditEvent = "deleted"
+	// AuditEventFailed means the Synapse delete room API returned an error.
+	AuditEventFailed AuditEvent = "failed"
+	// AuditEventRestored means the room was removed from the queues and unblocked with the admin API.
+	AuditEventRestored AuditEvent = "restored"
+)
+
+// AuditEntry is a single line in the audit log.
+type AuditEntry struct {
+	Time   time.Time  `json:"time"`
+	Event  AuditEvent `json:"event"`
+	RoomID id.RoomID  `json:"room_id"`
+	// Owner is the bridge bot whose rooms are being cleaned up.
+	Owner id.UserID `json:"owner,omitempty"`
+	// Requester is the user ID of the bridge bot that made the request, or "admin" for admin API requests.
+	Requester string `json:"requester,omitempty"`
+	// AdminKey is the name of the admin API key used for admin API requests.
+	AdminKey  string `json:"admin_key,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	RequestID int32  `json:"request_id,omitempty"`
+	// Decision is the rule that allowed the room to be cleaned up, or the reason it was rejected.
+	Decision string `json:"decision,omitempty"`
+	DryRun   bool   `json:"dry_run,omitempty"`
+
+	KickedUsers    []id.UserID     `json:"kicked_users,omitempty"`
+	RemovedAliases []id.RoomAlias  `json:"removed_aliases,omitempty"`
+	Blocked        bool            `json:"blocked,omitempty"`
+	DeleteResponse *RespDeleteRoom `json:"delete_response,omitempty"`
+	QueueTime      *time.Time      `json:"queue_time,omitempty"`
+	DurationMS     int64           `json:"duration_ms,omitempty"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// AuditQuery contains the filters for reading the audit log. Empty fields match everything.
+type AuditQuery struct {
+	RoomID id.RoomID
+	Owner  id.UserID
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (q *AuditQuery) Matches(entry *AuditEntry) bool {
+	return (len(q.RoomID) == 0 || entry.RoomID == q.RoomID) &&
+		(len(q.Owner) == 0 || entry.Owner == q.Owner) &&
+		(q.Since.IsZero() || !entry.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || entry.Time.Before(q.Until))
+}
+
+var auditLog = newSubsystemLogger(SubsystemAudit, "Audit")
+
+// auditLock is the mutex used to make sure audit log lines are written atomically.
+var auditLock sync.Mutex
+
+// WriteAudit appends the given entry to the audit log file.
+//
+// Failing to write the audit log is logged, but doesn't stop the cleanup.
+// If AUDIT_LOG_PATH is not set, this does nothing.
+func WriteAudit(ctx context.Context, entry AuditEntry) {
+	if len(cfg.AuditLogPath) == 0 {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.DryRun = isDryRunContext(ctx)
+	entryLog := auditLog.With(LogFields{"room_id": entry.RoomID, "owner": entry.Owner})
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		entryLog.Errorfln("Failed to marshal audit entry for %s: %v", entry.RoomID, err)
+		return
+	}
+	data = append(data, '\n')
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	file, err := os.OpenFile(cfg.AuditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		entryLog.Errorfln("Failed to open audit log to write entry for %s: %v", entry.RoomID, err)
+		return
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		entryLog.Errorfln("Failed to write audit entry for %s: %v", entry.RoomID, err)
+	}
+	_ = file.Close()
+}
+
+// WriteRequestAudit is a wrapper for WriteAudit that fills the request fields from the given context.
+func WriteRequestAudit(ctx context.Context, entry AuditEntry) {
+	if info, ok := ctx.Value(requestInfoContextKey).(*requestInfo); ok {
+		entry.ClientIP = info.ClientIP
+		entry.RequestID = info.ID
+	}
+	WriteAudit(ctx, entry)
+}
+
+// ReadAudit reads the audit log file and returns all entries that match the given query.
+func ReadAudit(query AuditQuery) ([]*AuditEntry, error) {
+	file, err := os.Open(cfg.AuditLogPath)
+	if os.IsNotExist(err) {
+		return []*AuditEntry{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	entries := make([]*AuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			auditLog.Warnln("Skipping unparseable line in audit log:", err)
+			continue
+		} else if query.Matches(&entry) {
+			entries = append(entries, &entry)
+			if query.Limit > 0 && len(entries) >= query.Limit {
+				break
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, nil
+}
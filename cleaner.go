@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"runtime/debug"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	log "maunium.net/go/maulogger/v2"
+	"go.opentelemetry.io/otel/trace"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 )
@@ -16,42 +18,225 @@ type OKResponse struct {
 	Removed uint64 `json:"removed"`
 	Skipped uint64 `json:"skipped"`
 	Failed  uint64 `json:"failed"`
+	// Unqueued is the number of rooms that weren't queued because the hourly room quota ran out.
+	Unqueued uint64 `json:"unqueued"`
 }
 
-func cleanRooms(ctx context.Context, client *mautrix.Client) (*OKResponse, error) {
-	reqLog := ctx.Value(logContextKey).(log.Logger)
+// JobAction is the type of request that a CleanJob is processing.
+type JobAction string
+
+const (
+	JobActionCleanAll  JobAction = "clean_all"
+	JobActionCancel    JobAction = "cancel"
+	JobActionCleanUser JobAction = "admin_clean_user"
+)
+
+// CleanJob is a clean_all, admin_clean_user or cancel request that is currently being processed.
+//
+// The owner drained notifications aren't sent while a bridge bot has active jobs.
+type CleanJob struct {
+	Owner     id.UserID `json:"owner"`
+	Action    JobAction `json:"action"`
+	StartedAt time.Time `json:"started_at"`
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	// dryRun is the dry run mode of the request that started the job, which the owner drained check is done in.
+	dryRun bool
+	// resp and err are the result of a clean_all job, which are returned to requests that joined the job.
+	resp *OKResponse
+	err  error
+}
+
+// activeJobsLock is the mutex used to lock reading/writing the activeJobs map.
+var activeJobsLock sync.Mutex
+
+// activeJobs contains the clean_all and cancel requests that are currently being processed.
+var activeJobs = make(map[*CleanJob]struct{})
+
+// startJob registers a new active job for the given bridge bot.
+//
+// The returned context is cancelled if the job is cancelled with CancelActiveJobs.
+// The caller must call finish when the job is done.
+func startJob(ctx context.Context, owner id.UserID, action JobAction) (context.Context, *CleanJob) {
+	ctx, cancel := context.WithCancel(ctx)
+	job := &CleanJob{Owner: owner, Action: action, StartedAt: time.Now(), cancel: cancel, done: make(chan struct{}), dryRun: isDryRunContext(ctx)}
+	activeJobsLock.Lock()
+	activeJobs[job] = struct{}{}
+	activeJobsLock.Unlock()
+	return ctx, job
+}
+
+// detachContext returns a context that isn't cancelled when the given request context is,
+// but keeps its logger, request info, dry run mode and trace span.
+func detachContext(ctx context.Context) context.Context {
+	return detachContextTo(context.Background(), ctx)
+}
+
+// detachContextTo is like detachContext, but the returned context is derived from the given parent context instead.
+func detachContextTo(parent, ctx context.Context) context.Context {
+	detached := contextWithDryRun(contextWithLog(parent, logFromContext(ctx)), isDryRunContext(ctx))
+	if info, ok := ctx.Value(requestInfoContextKey).(*requestInfo); ok {
+		detached = context.WithValue(detached, requestInfoContextKey, info)
+	}
+	return trace.ContextWithSpan(detached, trace.SpanFromContext(ctx))
+}
+
+// startOrJoinCleanJob is like startJob, but returns the existing clean_all job of the bridge bot if there is one.
+//
+// The job context of a new job is detached from the request context, as other requests may join the job.
+func startOrJoinCleanJob(ctx context.Context, owner id.UserID) (jobCtx context.Context, job *CleanJob, joined bool) {
+	activeJobsLock.Lock()
+	defer activeJobsLock.Unlock()
+	for existingJob := range activeJobs {
+		if existingJob.Owner == owner && existingJob.Action == JobActionCleanAll {
+			return nil, existingJob, true
+		}
+	}
+	jobCtx, cancel := context.WithCancel(detachContext(ctx))
+	job = &CleanJob{Owner: owner, Action: JobActionCleanAll, StartedAt: time.Now(), cancel: cancel, done: make(chan struct{}), dryRun: isDryRunContext(ctx)}
+	activeJobs[job] = struct{}{}
+	return jobCtx, job, false
+}
+
+// finish unregisters the job and sends the owner drained notifications if the owner has no rooms left in the queues.
+func (job *CleanJob) finish() {
+	activeJobsLock.Lock()
+	delete(activeJobs, job)
+	activeJobsLock.Unlock()
+	job.cancel()
+	close(job.done)
+	checkOwnerDrained(contextWithDryRun(context.Background(), job.dryRun), job.Owner)
+}
+
+// CancelActiveJobs stops all clean_all requests of the given bridge bot and waits for them to finish.
+func CancelActiveJobs(ctx context.Context, owner id.UserID) error {
+	var jobs []*CleanJob
+	activeJobsLock.Lock()
+	for job := range activeJobs {
+		if job.Owner == owner && job.Action == JobActionCleanAll {
+			jobs = append(jobs, job)
+		}
+	}
+	activeJobsLock.Unlock()
+	for _, job := range jobs {
+		job.cancel()
+		select {
+		case <-job.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// GetActiveJobs returns the clean_all and cancel requests that are currently being processed.
+func GetActiveJobs() []*CleanJob {
+	activeJobsLock.Lock()
+	defer activeJobsLock.Unlock()
+	jobs := make([]*CleanJob, 0, len(activeJobs))
+	for job := range activeJobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// HasActiveJob returns true if there's a clean_all, admin_clean_user or cancel request being processed for the given bridge bot.
+func HasActiveJob(owner id.UserID) bool {
+	activeJobsLock.Lock()
+	defer activeJobsLock.Unlock()
+	for job := range activeJobs {
+		if job.Owner == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanRooms queues all rooms of the bridge bot that the given client belongs to.
+//
+// If there's already a clean_all job running for the bridge bot, this waits for it and returns its result instead.
+// The job keeps running in the background if the request is cancelled.
+func cleanRooms(reqCtx context.Context, client *mautrix.Client) (*OKResponse, error) {
+	jobCtx, job, joined := startOrJoinCleanJob(reqCtx, client.UserID)
+	if joined {
+		logFromContext(reqCtx).Infoln(client.UserID, "requested a room cleanup, waiting for the cleanup that is already running")
+	} else {
+		go runCleanJob(jobCtx, job, client)
+	}
+	select {
+	case <-job.done:
+		return job.resp, job.err
+	case <-reqCtx.Done():
+		return nil, reqCtx.Err()
+	}
+}
+
+// runCleanJob queues all rooms of the bridge bot that the given client belongs to and stores the result in the job.
+func runCleanJob(ctx context.Context, job *CleanJob, client *mautrix.Client) {
+	defer job.finish()
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			job.resp, job.err = nil, fmt.Errorf("panic while cleaning rooms of %s: %v\n%s", client.UserID, panicErr, debug.Stack())
+		}
+	}()
+	job.resp, job.err = queueAllRooms(ctx, client)
+	// Rooms rejected by the rules are still bridged, so the ghosts and media are only cleaned up if every room was queued
+	if job.err == nil && job.resp.Failed == 0 && job.resp.Unqueued == 0 && job.resp.Skipped == 0 {
+		MarkOwnerFullCleanup(ctx, client.UserID)
+	}
+}
+
+// queueAllRooms checks all rooms of the bridge bot that the given client belongs to and pushes the allowed ones to the leave queue.
+func queueAllRooms(ctx context.Context, client *mautrix.Client) (resp *OKResponse, err error) {
+	reqLog := logFromContext(ctx)
+	if limitErr := ReserveRoomQuota(ctx, client.UserID, 0); limitErr != nil {
+		return nil, limitErr
+	}
 	reqLog.Infoln(client.UserID, "requested a room cleanup")
+	SendWebhook(ctx, WebhookCleanupAccepted, WebhookPayload{Owner: client.UserID})
 	rooms, err := GetRoomList(ctx, client)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get room list: %w", err)
 	}
 	reqLog.Debugln("Found", len(rooms), "rooms")
 
-	var resp OKResponse
-	var wg sync.WaitGroup
+	resp = &OKResponse{}
+	// quotaExceeded is set when the room quota runs out, after which the remaining rooms are skipped.
+	var quotaExceeded int32
+	var wg, threads sync.WaitGroup
 	wg.Add(len(rooms))
 	queue := make(chan id.RoomID)
-	for i := 1; i <= cfg.ThreadCount; i++ {
-		threadContext := context.WithValue(ctx, logContextKey, reqLog.Sub(fmt.Sprintf("Thread-%d", i)))
-		go cleanRoomsThread(threadContext, client, queue, &wg, &resp)
+	for i := 1; i <= getThreadCount(); i++ {
+		threadContext := contextWithLog(ctx, reqLog.Sub(fmt.Sprintf("Thread-%d", i)))
+		threads.Add(1)
+		go func() {
+			defer threads.Done()
+			cleanRoomsThread(threadContext, client, queue, &wg, resp, &quotaExceeded)
+		}()
 	}
 	for _, roomID := range rooms {
 		select {
 		case queue <- roomID:
 		case <-ctx.Done():
-			reqLog.Warnfln("Room cleanup for %s was canceled before it completed. Status: %+v", client.UserID, resp)
 			close(queue)
-			return &resp, ctx.Err()
+			// Wait for rooms that are already being processed so that nothing is queued after the job is finished
+			threads.Wait()
+			reqLog.Warnfln("Room cleanup for %s was canceled before it completed. Status: %+v", client.UserID, *resp)
+			return resp, ctx.Err()
 		}
 	}
 	wg.Wait()
 	close(queue)
-	reqLog.Infofln("Room cleanup for %s completed successfully. Status: %+v", client.UserID, resp)
-	return &resp, nil
+	if resp.Unqueued > 0 {
+		reqLog.Infofln("Room quota of %s ran out, %d rooms were left unqueued", client.UserID, resp.Unqueued)
+	}
+	reqLog.Infofln("Room cleanup for %s completed successfully. Status: %+v", client.UserID, *resp)
+	return resp, nil
 }
 
-func cleanRoomsThread(ctx context.Context, client *mautrix.Client, queue <-chan id.RoomID, wg *sync.WaitGroup, resp *OKResponse) {
-	reqLog := ctx.Value(logContextKey).(log.Logger)
+func cleanRoomsThread(ctx context.Context, client *mautrix.Client, queue <-chan id.RoomID, wg *sync.WaitGroup, resp *OKResponse, quotaExceeded *int32) {
+	reqLog := logFromContext(ctx)
 	defer func() {
 		err := recover()
 		if err != nil {
@@ -64,8 +249,17 @@ func cleanRoomsThread(ctx context.Context, client *mautrix.Client, queue <-chan
 			if !ok {
 				return
 			}
+			if atomic.LoadInt32(quotaExceeded) != 0 {
+				atomic.AddUint64(&resp.Unqueued, 1)
+				wg.Done()
+				continue
+			}
+			var limitErr *LimitExceededError
 			allowed, err := cleanRoom(ctx, client, roomID)
-			if err != nil {
+			if errors.As(err, &limitErr) {
+				atomic.StoreInt32(quotaExceeded, 1)
+				atomic.AddUint64(&resp.Unqueued, 1)
+			} else if err != nil {
 				reqLog.Warnfln("Failed to clean up %s: %v", roomID, err)
 				atomic.AddUint64(&resp.Failed, 1)
 			} else if allowed {
@@ -81,7 +275,12 @@ func cleanRoomsThread(ctx context.Context, client *mautrix.Client, queue <-chan
 }
 
 func cleanRoom(ctx context.Context, client *mautrix.Client, roomID id.RoomID) (allowed bool, err error) {
-	reqLog := ctx.Value(logContextKey).(log.Logger)
+	reqLog := roomLogger(logFromContext(ctx), roomID, client.UserID, StageFilter)
+	ctx = contextWithLog(ctx, reqLog)
+	ctx, span := startSpan(ctx, "clean_room", roomID, client.UserID)
+	defer func() {
+		endSpan(span, err)
+	}()
 	defer func() {
 		panicErr := recover()
 		if panicErr != nil {
@@ -89,16 +288,40 @@ func cleanRoom(ctx context.Context, client *mautrix.Client, roomID id.RoomID) (a
 		}
 	}()
 
-	usersToKick, permissionErr := IsAllowedToCleanRoom(ctx, client, roomID)
+	usersToKick, decision, permissionErr := IsAllowedToCleanRoom(ctx, client, roomID)
+	observeStageError(client.UserID, StageFilter, permissionErr)
 	if permissionErr != nil {
 		reqLog.Debugfln("Skipping room %s as cleaning is not allowed: %v", roomID, permissionErr)
+		WriteRequestAudit(ctx, AuditEntry{
+			Event:     AuditEventRejected,
+			RoomID:    roomID,
+			Owner:     client.UserID,
+			Requester: client.UserID.String(),
+			Decision:  permissionErr.Error(),
+		})
 		return
 	}
+	if limitErr := ReserveRoomQuota(ctx, client.UserID, 1); limitErr != nil {
+		reqLog.Debugfln("Not queuing %s as the room quota ran out: %v", roomID, limitErr)
+		return false, limitErr
+	}
 	allowed = true
 
-	err = PushLeaveQueue(ctx, roomID, usersToKick)
-	if err == nil {
+	err = PushLeaveQueue(ctx, newBridgeLeavingRoom(ctx, client, roomID, usersToKick))
+	if err != nil {
+		if _, quotaErr := AddRoomQuota(ctx, client.UserID, -1); quotaErr != nil {
+			reqLog.Warnfln("Failed to return %s to the room quota of %s: %v", roomID, client.UserID, quotaErr)
+		}
+	} else {
+		TrackOwnerRoom(ctx, client.UserID)
 		reqLog.Debugfln("Room %s queued for leaving", roomID)
+		WriteRequestAudit(ctx, AuditEntry{
+			Event:     AuditEventQueued,
+			RoomID:    roomID,
+			Owner:     client.UserID,
+			Requester: client.UserID.String(),
+			Decision:  decision,
+		})
 	}
 
 	return
@@ -1,103 +1,465 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
+	"gopkg.in/yaml.v3"
 	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
 )
 
 type Config struct {
-	ListenAddress      string
-	SynapseURL         string
-	AsmuxURL           string
-	AsmuxMainURL       *url.URL
-	AsmuxDatabaseURL   string
-	AsmuxAccessToken   string
-	AsmuxASToken       string
-	AdminAccessToken   string
-	AdminUsername      string
-	AdminPassword      string
-	ThreadCount        int
-	QueueSleep         time.Duration
-	TrustForwardHeader bool
-	DryRun             bool
-	ForcePurge         bool
-	RedisURL           string
+	ListenAddress            string
+	SynapseURL               string
+	AsmuxURL                 string
+	AsmuxMainURL             *url.URL
+	AsmuxDatabaseURL         string
+	AsmuxAccessToken         string
+	AsmuxASToken             string
+	AdminAccessToken         string
+	AdminUsername            string
+	AdminPassword            string
+	AdminAPIKeys             []*AdminAPIKey
+	ThreadCount              int
+	QueueSleep               time.Duration
+	TrustForwardHeader       bool
+	DryRun                   bool
+	ForcePurge               bool
+	SoftDelete               bool
+	DeleteBlock              bool
+	DeleteNewRoomUserID      id.UserID
+	DeleteRoomName           string
+	DeleteMessage            string
+	FarewellTemplate         *template.Template
+	FarewellSupportURL       string
+	FarewellInterval         time.Duration
+	DeactivateGhosts         bool
+	DeactivateGhostsInterval time.Duration
+	MediaCleanup             bool
+	MediaMinAge              time.Duration
+	MediaBatchSize           int
+	MediaCleanupInterval     time.Duration
+	RedisURL                 string
+	RedisOptions             *RedisOptions
+	EncryptionKeys           *EncryptionKeys
+	// HashKey is the key for hashing bridge bot user IDs in redis key names. It can't be changed at runtime.
+	HashKey            []byte
 	PostponeDeletion   time.Duration
+	AuditLogPath       string
+	SnapshotDir        string
+	SnapshotS3Endpoint string
+	SnapshotS3Bucket   string
+	SnapshotS3Region   string
+	SnapshotS3Access   string
+	SnapshotS3Secret   string
+	Debug              bool
+	LogFormat          string
+	LogLevel           log.Level
+	LogLevels          map[string]log.Level
+	TracingEndpoint    string
+
+	LeaveWindows  *MaintenanceSchedule
+	DeleteWindows *MaintenanceSchedule
+
+	RateLimitPerMinute int
+	RateLimitBurst     int
+	RoomQuotaPerHour   int64
+
+	WebhookURLs                []string
+	WebhookSecret              string
+	WebhookErrorQueueThreshold int64
+
+	// AllowedLocalpartRegex is the regex matching localparts of users who are allowed to use the cleanup service.
+	// The first two capture groups must be the bridge user localpart and the bridge name.
+	AllowedLocalpartRegex *regexp.Regexp
 }
 
 var cfg Config
 
+// cfgLock protects the fields of cfg that can be changed at runtime by sending SIGHUP (see reloadConfig).
+var cfgLock sync.RWMutex
+
+func isDryRun() bool {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.DryRun
+}
+
+// contextWithDryRun returns a copy of the given context that is in dry run mode if dryRun is true.
+//
+// Queue items keep the mode they were queued in, so that changing DRY_RUN with SIGHUP doesn't affect rooms in flight.
+func contextWithDryRun(ctx context.Context, dryRun bool) context.Context {
+	return context.WithValue(ctx, dryRunContextKey, dryRun)
+}
+
+// isDryRunContext returns whether the given context is in dry run mode, or the current DRY_RUN setting if it doesn't say.
+func isDryRunContext(ctx context.Context) bool {
+	if dryRun, ok := ctx.Value(dryRunContextKey).(bool); ok {
+		return dryRun
+	}
+	return isDryRun()
+}
+
+func getQueueSleep() time.Duration {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.QueueSleep
+}
+
+func getThreadCount() int {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.ThreadCount
+}
+
+func getPostponeDeletion() time.Duration {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.PostponeDeletion
+}
+
+func getAllowedLocalpartRegex() *regexp.Regexp {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.AllowedLocalpartRegex
+}
+
 func isTruthy(env string) bool {
 	env = strings.ToLower(strings.TrimSpace(env))
 	return env == "1" || env == "t" || env == "true" || env == "y" || env == "yes"
 }
 
-func readEnv() {
-	cfg.ListenAddress = os.Getenv("LISTEN_ADDRESS")
-	cfg.SynapseURL = os.Getenv("SYNAPSE_URL")
-	cfg.AsmuxURL = os.Getenv("ASMUX_URL")
-	cfg.AsmuxDatabaseURL = os.Getenv("ASMUX_DATABASE_URL")
-	if len(cfg.AsmuxURL) == 0 {
-		cfg.AsmuxURL = cfg.SynapseURL
+// configSource reads settings from environment variables, falling back to the YAML config file.
+//
+// Keys in the config file are the lowercase versions of the environment variable names.
+// Non-scalar values in the config file are converted to JSON.
+// Values encrypted with `yeetserv encrypt` are decrypted once the encryption keys have been read.
+type configSource struct {
+	file map[string]string
+	errs []string
+	keys *EncryptionKeys
+}
+
+func newConfigSource() *configSource {
+	src := &configSource{file: make(map[string]string)}
+	path := os.Getenv("CONFIG_FILE")
+	if len(path) == 0 {
+		return src
 	}
-	if _, isSet := os.LookupEnv("ASMUX_MAIN_URL"); isSet {
-		var err error
-		cfg.AsmuxMainURL, err = url.Parse(os.Getenv("ASMUX_MAIN_URL"))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		src.errorf("Failed to read config file: %v", err)
+		return src
+	}
+	var raw map[string]interface{}
+	if err = yaml.Unmarshal(data, &raw); err != nil {
+		src.errorf("Failed to parse config file: %v", err)
+		return src
+	}
+	for key, val := range raw {
+		switch typedVal := val.(type) {
+		case nil:
+		case []interface{}, map[string]interface{}:
+			jsonVal, err := json.Marshal(typedVal)
+			if err != nil {
+				src.errorf("Failed to convert %s in config file to JSON: %v", key, err)
+			} else {
+				src.file[strings.ToUpper(key)] = string(jsonVal)
+			}
+		default:
+			src.file[strings.ToUpper(key)] = fmt.Sprint(typedVal)
+		}
+	}
+	return src
+}
+
+func (src *configSource) errorf(message string, args ...interface{}) {
+	src.errs = append(src.errs, fmt.Sprintf(message, args...))
+}
+
+func (src *configSource) lookup(name string) (string, bool) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		val, ok = src.file[name]
+	}
+	if ok && isEncrypted(val) {
+		plaintext, err := src.keys.Decrypt(val)
 		if err != nil {
-			log.Fatalln("Failed to parse asmux main URL:", err)
-			os.Exit(2)
+			src.errorf("Failed to decrypt %s: %v", name, err)
+			return "", true
 		}
+		val = string(plaintext)
 	}
-	cfg.AdminAccessToken = os.Getenv("ADMIN_ACCESS_TOKEN")
-	cfg.AdminUsername = os.Getenv("ADMIN_USERNAME")
-	cfg.AdminPassword = os.Getenv("ADMIN_PASSWORD")
-	cfg.AsmuxAccessToken = os.Getenv("ASMUX_ACCESS_TOKEN")
-	cfg.AsmuxASToken = os.Getenv("ASMUX_AS_TOKEN")
-	cfg.TrustForwardHeader = isTruthy(os.Getenv("TRUST_FORWARD_HEADERS"))
-	cfg.DryRun = isTruthy(os.Getenv("DRY_RUN"))
-	cfg.ForcePurge = isTruthy(os.Getenv("FORCE_PURGE"))
-	cfg.RedisURL = os.Getenv("REDIS_URL")
-	if isTruthy(os.Getenv("DEBUG")) {
-		log.DefaultLogger.PrintLevel = log.LevelDebug.Severity
-	}
-	log.DefaultLogger.TimeFormat = "Jan _2, 2006 15:04:05"
-	queueSleepStr := os.Getenv("QUEUE_SLEEP")
-	if len(queueSleepStr) == 0 {
-		queueSleepStr = "60"
-	}
-	queueSleepInt, err := strconv.Atoi(queueSleepStr)
+	return val, ok
+}
+
+func (src *configSource) get(name string) string {
+	val, _ := src.lookup(name)
+	return val
+}
+
+func (src *configSource) getDefault(name, defaultVal string) string {
+	if val := src.get(name); len(val) > 0 {
+		return val
+	}
+	return defaultVal
+}
+
+func (src *configSource) getBool(name string) bool {
+	return isTruthy(src.get(name))
+}
+
+func (src *configSource) getInt(name string, defaultVal int) int {
+	val := src.get(name)
+	if len(val) == 0 {
+		return defaultVal
+	}
+	intVal, err := strconv.Atoi(val)
 	if err != nil {
-		log.Fatalln("QUEUE_SLEEP environment variable is not an integer")
-		os.Exit(2)
+		src.errorf("%s is not an integer", name)
+		return defaultVal
+	}
+	return intVal
+}
+
+func (src *configSource) getDuration(name string, defaultVal time.Duration) time.Duration {
+	val := src.get(name)
+	if len(val) == 0 {
+		return defaultVal
+	}
+	duration, err := time.ParseDuration(val)
+	if err != nil {
+		src.errorf("%s is not a valid duration: %v", name, err)
+		return defaultVal
+	}
+	return duration
+}
+
+// getList reads a list setting, which is either a comma-separated string or a list in the config file.
+func (src *configSource) getList(name string) []string {
+	val := strings.TrimSpace(src.get(name))
+	if len(val) == 0 {
+		return nil
 	}
-	cfg.QueueSleep = time.Duration(queueSleepInt) * time.Second
-	if cfg.PostponeDeletion, err = time.ParseDuration(os.Getenv("POSTPONE_DELETION")); err != nil {
-		cfg.PostponeDeletion = time.Second * 0
+	var list []string
+	if strings.HasPrefix(val, "[") {
+		if err := json.Unmarshal([]byte(val), &list); err != nil {
+			src.errorf("%s is not a valid list: %v", name, err)
+		}
+		return list
 	}
-	threadCountStr := os.Getenv("THREAD_COUNT")
-	if len(threadCountStr) == 0 {
-		threadCountStr = "5"
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
 	}
-	cfg.ThreadCount, err = strconv.Atoi(threadCountStr)
+	return list
+}
+
+// getMaintenanceSchedule reads a list of maintenance windows and the time zone they're in, which defaults to UTC.
+func (src *configSource) getMaintenanceSchedule(windowsName, timezoneName string) *MaintenanceSchedule {
+	sched, err := parseMaintenanceSchedule(src.getList(windowsName), src.getDefault(timezoneName, "UTC"))
 	if err != nil {
-		log.Fatalln("THREAD_COUNT environment variable is not an integer")
-	} else if len(cfg.ListenAddress) == 0 {
-		log.Fatalln("LISTEN_ADDRESS environment variable is not set")
-	} else if len(cfg.SynapseURL) == 0 {
-		log.Fatalln("SYNAPSE_URL environment variable is not set")
-	} else if len(cfg.AdminAccessToken) == 0 {
-		if len(cfg.AdminUsername) == 0 && len(cfg.AdminPassword) == 0 {
-			log.Fatalln("ADMIN_ACCESS_TOKEN environment variable is not set and ADMIN_USERNAME+ADMIN_PASSWORD is not set")
-		} else {
-			return
+		src.errorf("Failed to parse %s: %v", windowsName, err)
+	}
+	return sched
+}
+
+func (src *configSource) require(name, val string) {
+	if len(val) == 0 {
+		src.errorf("%s is not set", name)
+	}
+}
+
+// loadConfig reads and validates the config from environment variables and the config file.
+//
+// All validation problems are returned at once instead of stopping at the first one.
+func loadConfig() (*Config, []string) {
+	src := newConfigSource()
+	var conf Config
+	conf.EncryptionKeys = src.getEncryptionKeys("QUEUE_ENCRYPTION_KEY", "QUEUE_ENCRYPTION_OLD_KEYS")
+	// User IDs in redis key names must be hashed if the queue entries are encrypted, as the point is to not have them in redis
+	conf.HashKey = src.getHashKey("QUEUE_HASH_KEY", conf.EncryptionKeys != nil && conf.EncryptionKeys.Current != nil)
+	src.keys = conf.EncryptionKeys
+	conf.ListenAddress = src.get("LISTEN_ADDRESS")
+	src.require("LISTEN_ADDRESS", conf.ListenAddress)
+	conf.SynapseURL = src.get("SYNAPSE_URL")
+	src.require("SYNAPSE_URL", conf.SynapseURL)
+	conf.AsmuxURL = src.getDefault("ASMUX_URL", conf.SynapseURL)
+	conf.AsmuxDatabaseURL = src.get("ASMUX_DATABASE_URL")
+	if asmuxMainURL, isSet := src.lookup("ASMUX_MAIN_URL"); isSet {
+		var err error
+		conf.AsmuxMainURL, err = url.Parse(asmuxMainURL)
+		if err != nil {
+			src.errorf("Failed to parse asmux main URL: %v", err)
 		}
+	}
+	conf.AdminAccessToken = src.get("ADMIN_ACCESS_TOKEN")
+	conf.AdminUsername = src.get("ADMIN_USERNAME")
+	conf.AdminPassword = src.get("ADMIN_PASSWORD")
+	if len(conf.AdminAccessToken) == 0 && (len(conf.AdminUsername) == 0 || len(conf.AdminPassword) == 0) {
+		src.errorf("ADMIN_ACCESS_TOKEN is not set and ADMIN_USERNAME+ADMIN_PASSWORD is not set")
+	}
+	if adminAPIKeys, err := parseAdminAPIKeys(src.get("ADMIN_API_KEYS")); err != nil {
+		src.errorf("Failed to parse ADMIN_API_KEYS: %v", err)
 	} else {
+		conf.AdminAPIKeys = adminAPIKeys
+	}
+	conf.AsmuxAccessToken = src.get("ASMUX_ACCESS_TOKEN")
+	conf.AsmuxASToken = src.get("ASMUX_AS_TOKEN")
+	conf.TrustForwardHeader = src.getBool("TRUST_FORWARD_HEADERS")
+	conf.DryRun = src.getBool("DRY_RUN")
+	conf.ForcePurge = src.getBool("FORCE_PURGE")
+	conf.SoftDelete = src.getBool("SOFT_DELETE")
+	conf.DeleteBlock = src.getBool("DELETE_BLOCK")
+	conf.DeleteNewRoomUserID = id.UserID(src.get("DELETE_NEW_ROOM_USER_ID"))
+	conf.DeleteRoomName = src.get("DELETE_ROOM_NAME")
+	conf.DeleteMessage = src.get("DELETE_MESSAGE")
+	if farewellMessage := src.get("FAREWELL_MESSAGE"); len(farewellMessage) > 0 {
+		var err error
+		conf.FarewellTemplate, err = template.New("farewell").Parse(farewellMessage)
+		if err != nil {
+			src.errorf("Failed to parse farewell message template: %v", err)
+		} else if len(conf.AsmuxASToken) == 0 {
+			src.errorf("FAREWELL_MESSAGE is set, but ASMUX_AS_TOKEN is not")
+		}
+	}
+	conf.FarewellSupportURL = src.get("FAREWELL_SUPPORT_URL")
+	conf.FarewellInterval = src.getDuration("FAREWELL_INTERVAL", 1*time.Second)
+	conf.DeactivateGhosts = src.getBool("DEACTIVATE_GHOSTS")
+	conf.DeactivateGhostsInterval = src.getDuration("DEACTIVATE_GHOSTS_INTERVAL", 1*time.Second)
+	conf.MediaCleanup = src.getBool("MEDIA_CLEANUP")
+	conf.MediaMinAge = src.getDuration("MEDIA_MIN_AGE", 24*time.Hour)
+	conf.MediaBatchSize = src.getInt("MEDIA_BATCH_SIZE", 100)
+	if conf.MediaBatchSize < 1 {
+		src.errorf("MEDIA_BATCH_SIZE must be at least 1")
+	}
+	conf.MediaCleanupInterval = src.getDuration("MEDIA_CLEANUP_INTERVAL", 1*time.Second)
+	conf.RedisURL = src.get("REDIS_URL")
+	if len(conf.RedisURL) > 0 {
+		var err error
+		if conf.RedisOptions, err = parseRedisURL(conf.RedisURL); err != nil {
+			src.errorf("Failed to parse REDIS_URL: %v", err)
+		}
+	}
+	conf.AuditLogPath = src.get("AUDIT_LOG_PATH")
+	conf.SnapshotDir = src.get("SNAPSHOT_DIR")
+	conf.SnapshotS3Endpoint = src.get("SNAPSHOT_S3_ENDPOINT")
+	conf.SnapshotS3Bucket = src.get("SNAPSHOT_S3_BUCKET")
+	if len(conf.SnapshotS3Bucket) > 0 && len(conf.SnapshotS3Endpoint) == 0 {
+		src.errorf("SNAPSHOT_S3_BUCKET is set, but SNAPSHOT_S3_ENDPOINT is not")
+	}
+	conf.SnapshotS3Region = src.getDefault("SNAPSHOT_S3_REGION", "us-east-1")
+	conf.SnapshotS3Access = src.get("SNAPSHOT_S3_ACCESS_KEY")
+	conf.SnapshotS3Secret = src.get("SNAPSHOT_S3_SECRET_KEY")
+	conf.Debug = src.getBool("DEBUG")
+	conf.LogFormat = strings.ToLower(src.getDefault("LOG_FORMAT", "text"))
+	if conf.LogFormat != "text" && conf.LogFormat != "json" {
+		src.errorf("LOG_FORMAT must be text or json")
+	}
+	conf.LogLevel = log.LevelInfo
+	if conf.Debug {
+		conf.LogLevel = log.LevelDebug
+	}
+	if logLevel := src.get("LOG_LEVEL"); len(logLevel) > 0 {
+		var err error
+		if conf.LogLevel, err = parseLogLevel(logLevel); err != nil {
+			src.errorf("Failed to parse LOG_LEVEL: %v", err)
+		}
+	}
+	if logLevels, err := parseLogLevels(src.get("LOG_LEVELS")); err != nil {
+		src.errorf("Failed to parse LOG_LEVELS: %v", err)
+	} else {
+		conf.LogLevels = logLevels
+	}
+	conf.TracingEndpoint = src.get("TRACING_ENDPOINT")
+
+	conf.WebhookURLs = src.getList("WEBHOOK_URLS")
+	for _, webhookURL := range conf.WebhookURLs {
+		if parsed, err := url.Parse(webhookURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			src.errorf("Invalid webhook URL %q", webhookURL)
+		}
+	}
+	conf.WebhookSecret = src.get("WEBHOOK_SECRET")
+	if len(conf.WebhookURLs) > 0 {
+		src.require("WEBHOOK_SECRET", conf.WebhookSecret)
+	}
+	conf.WebhookErrorQueueThreshold = int64(src.getInt("WEBHOOK_ERROR_QUEUE_THRESHOLD", 0))
+
+	conf.RateLimitPerMinute = src.getInt("RATE_LIMIT_PER_MINUTE", 60)
+	conf.RateLimitBurst = src.getInt("RATE_LIMIT_BURST", 10)
+	if conf.RateLimitPerMinute > 0 && conf.RateLimitBurst < 1 {
+		src.errorf("RATE_LIMIT_BURST must be at least 1")
+	}
+	conf.RoomQuotaPerHour = int64(src.getInt("ROOM_QUOTA_PER_HOUR", 0))
+
+	conf.QueueSleep = time.Duration(src.getInt("QUEUE_SLEEP", 60)) * time.Second
+	if conf.QueueSleep < 0 {
+		src.errorf("QUEUE_SLEEP must not be negative")
+	}
+	conf.PostponeDeletion = src.getDuration("POSTPONE_DELETION", 0)
+	conf.LeaveWindows = src.getMaintenanceSchedule("LEAVE_WINDOWS", "LEAVE_WINDOWS_TIMEZONE")
+	conf.DeleteWindows = src.getMaintenanceSchedule("DELETE_WINDOWS", "DELETE_WINDOWS_TIMEZONE")
+	conf.ThreadCount = src.getInt("THREAD_COUNT", 5)
+	if conf.ThreadCount < 1 {
+		src.errorf("THREAD_COUNT must be at least 1")
+	}
+	var err error
+	conf.AllowedLocalpartRegex, err = regexp.Compile(src.getDefault("ALLOWED_LOCALPART_REGEX", DefaultAllowedLocalpartRegex))
+	if err != nil {
+		src.errorf("Failed to parse ALLOWED_LOCALPART_REGEX: %v", err)
+	} else if conf.AllowedLocalpartRegex.NumSubexp() != 2 {
+		src.errorf("ALLOWED_LOCALPART_REGEX must have exactly two capture groups")
+	}
+	return &conf, src.errs
+}
+
+func readConfig() {
+	conf, errs := loadConfig()
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Fatalln(err)
+		}
+		os.Exit(2)
+	}
+	cfg = *conf
+	configureLogging()
+}
+
+// reloadConfig re-reads the config and applies the settings that are safe to change at runtime.
+//
+// If the new config is invalid, the old config is kept. Other settings require a restart to change.
+func reloadConfig() {
+	conf, errs := loadConfig()
+	if len(errs) > 0 {
+		log.Errorln("Not reloading config as it contains errors:")
+		for _, err := range errs {
+			log.Errorln(" -", err)
+		}
 		return
 	}
-	os.Exit(2)
+	cfgLock.Lock()
+	cfg.QueueSleep = conf.QueueSleep
+	cfg.ThreadCount = conf.ThreadCount
+	cfg.DryRun = conf.DryRun
+	cfg.PostponeDeletion = conf.PostponeDeletion
+	cfg.AllowedLocalpartRegex = conf.AllowedLocalpartRegex
+	cfg.LeaveWindows = conf.LeaveWindows
+	cfg.DeleteWindows = conf.DeleteWindows
+	cfg.AdminAPIKeys = conf.AdminAPIKeys
+	cfg.EncryptionKeys = conf.EncryptionKeys
+	cfgLock.Unlock()
+	log.Infofln("Reloaded config: queue sleep %v, thread count %d, dry run %t, postpone deletion %v, allowed localpart regex %s",
+		conf.QueueSleep, conf.ThreadCount, conf.DryRun, conf.PostponeDeletion, conf.AllowedLocalpartRegex)
+	promLeaveQueuePostponeDurationGuage.Set(conf.PostponeDeletion.Seconds())
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// encryptedSecretPrefix is the prefix of values encrypted with EncryptionKeys.Encrypt.
+const encryptedSecretPrefix = "enc:v1:"
+
+// EncryptionKey is an AES-256-GCM key used to encrypt secrets and queue items stored in redis.
+type EncryptionKey struct {
+	// ID identifies the key in encrypted values. It's the hex-encoded start of the SHA-256 hash of the key.
+	ID   string
+	aead cipher.AEAD
+}
+
+// EncryptionKeys contains the key used to encrypt new values and the old keys that can still be used to decrypt values.
+//
+// Keys are rotated by moving the current key to the old keys and setting a new current key.
+// Once all values encrypted with an old key are gone from redis, the old key can be removed.
+type EncryptionKeys struct {
+	Current *EncryptionKey
+	Old     []*EncryptionKey
+}
+
+// parseKey decodes a base64-encoded 32-byte key.
+func parseKey(val string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid base64: %w", err)
+	} else if len(raw) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(raw))
+	}
+	return raw, nil
+}
+
+// parseEncryptionKey parses a base64-encoded 32-byte key.
+func parseEncryptionKey(val string) (*EncryptionKey, error) {
+	raw, err := parseKey(val)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(raw)
+	return &EncryptionKey{ID: hex.EncodeToString(hash[:4]), aead: aead}, nil
+}
+
+// hashIdentifier returns a hex-encoded HMAC of the given value, which is used instead of the value in redis key names.
+func hashIdentifier(hashKey []byte, val string) string {
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte(val))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// readSettingFile returns the value of the given setting, or the contents of the file in the setting with the _FILE suffix.
+func (src *configSource) readSettingFile(name string) string {
+	val := src.get(name)
+	if path := src.get(name + "_FILE"); len(val) == 0 && len(path) > 0 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			src.errorf("Failed to read %s_FILE: %v", name, err)
+			return ""
+		}
+		val = string(data)
+	}
+	return val
+}
+
+// getEncryptionKeys reads the current encryption key and the old keys.
+//
+// The old keys are a list like other list settings. In the _FILE variant, they're separated by newlines.
+func (src *configSource) getEncryptionKeys(currentName, oldName string) *EncryptionKeys {
+	var keys EncryptionKeys
+	if val := src.readSettingFile(currentName); len(val) > 0 {
+		var err error
+		if keys.Current, err = parseEncryptionKey(val); err != nil {
+			src.errorf("Failed to parse %s: %v", currentName, err)
+		}
+	}
+	oldVals := src.getList(oldName)
+	if len(oldVals) == 0 {
+		oldVals = strings.Fields(src.readSettingFile(oldName))
+	}
+	for i, val := range oldVals {
+		key, err := parseEncryptionKey(val)
+		if err != nil {
+			src.errorf("Failed to parse key #%d in %s: %v", i+1, oldName, err)
+		} else {
+			keys.Old = append(keys.Old, key)
+		}
+	}
+	if keys.Current == nil && len(keys.Old) == 0 {
+		return nil
+	}
+	return &keys
+}
+
+// getHashKey reads the key used for hashing identifiers in redis key names.
+func (src *configSource) getHashKey(name string, required bool) []byte {
+	val := src.readSettingFile(name)
+	if len(val) == 0 {
+		if required {
+			src.errorf("%s is not set, but it's required when QUEUE_ENCRYPTION_KEY is set", name)
+		}
+		return nil
+	}
+	key, err := parseKey(val)
+	if err != nil {
+		src.errorf("Failed to parse %s: %v", name, err)
+	}
+	return key
+}
+
+// find returns the key with the given ID, or nil if there isn't one.
+func (keys *EncryptionKeys) find(keyID string) *EncryptionKey {
+	if keys == nil {
+		return nil
+	} else if keys.Current != nil && keys.Current.ID == keyID {
+		return keys.Current
+	}
+	for _, key := range keys.Old {
+		if key.ID == keyID {
+			return key
+		}
+	}
+	return nil
+}
+
+// Encrypt encrypts the given value with the current key.
+func (keys *EncryptionKeys) Encrypt(plaintext []byte) (string, error) {
+	if keys == nil || keys.Current == nil {
+		return "", fmt.Errorf("QUEUE_ENCRYPTION_KEY is not set")
+	}
+	key := keys.Current
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := key.aead.Seal(nonce, nonce, plaintext, nil)
+	return encryptedSecretPrefix + key.ID + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value encrypted with Encrypt using the current key or one of the old keys.
+func (keys *EncryptionKeys) Decrypt(encrypted string) ([]byte, error) {
+	if !isEncrypted(encrypted) {
+		return nil, fmt.Errorf("value is not encrypted")
+	}
+	keyID, data, found := strings.Cut(strings.TrimPrefix(encrypted, encryptedSecretPrefix), ":")
+	if !found {
+		return nil, fmt.Errorf("encrypted value doesn't have a key ID")
+	}
+	key := keys.find(keyID)
+	if key == nil {
+		return nil, fmt.Errorf("unknown encryption key %s", keyID)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode encrypted value: %w", err)
+	}
+	nonceSize := key.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	plaintext, err := key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	return plaintext, nil
+}
+
+// isEncrypted returns true if the given value was encrypted with EncryptionKeys.Encrypt.
+func isEncrypted(val string) bool {
+	return strings.HasPrefix(val, encryptedSecretPrefix)
+}
+
+func getEncryptionKeys() *EncryptionKeys {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.EncryptionKeys
+}
+
+// canEncryptSecrets returns true if a current encryption key is configured.
+func canEncryptSecrets() bool {
+	keys := getEncryptionKeys()
+	return keys != nil && keys.Current != nil
+}
+
+// encryptSecret encrypts the given value with the current encryption key.
+func encryptSecret(plaintext []byte) (string, error) {
+	return getEncryptionKeys().Encrypt(plaintext)
+}
+
+// decryptSecret decrypts a value encrypted with any of the configured encryption keys.
+func decryptSecret(encrypted string) ([]byte, error) {
+	return getEncryptionKeys().Decrypt(encrypted)
+}
+
+// ownerRedisID returns the identifier of the given bridge bot used in redis key names and hash fields.
+//
+// If QUEUE_HASH_KEY is set, it's an HMAC of the user ID so that redis doesn't contain user IDs in plaintext.
+// The hash key is separate from the encryption keys so that the identifiers don't change when the keys are rotated.
+func ownerRedisID(owner id.UserID) string {
+	if cfg.HashKey == nil {
+		return owner.String()
+	}
+	return hashIdentifier(cfg.HashKey, owner.String())
+}
+
+// runEncryptCommand encrypts the value from stdin with QUEUE_ENCRYPTION_KEY and prints it,
+// for storing secret settings in encrypted form in the config.
+func runEncryptCommand() {
+	src := newConfigSource()
+	keys := src.getEncryptionKeys("QUEUE_ENCRYPTION_KEY", "QUEUE_ENCRYPTION_OLD_KEYS")
+	if len(src.errs) > 0 {
+		for _, err := range src.errs {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
+	plaintext, err := io.ReadAll(bufio.NewReader(os.Stdin))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to read value:", err)
+		os.Exit(1)
+	}
+	encrypted, err := keys.Encrypt([]byte(strings.TrimRight(string(plaintext), "\r\n")))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to encrypt value:", err)
+		os.Exit(1)
+	}
+	fmt.Println(encrypted)
+}
@@ -5,38 +5,177 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/url"
-	"os"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
 	log "maunium.net/go/maulogger/v2"
 
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 )
 
+// DeleteOptions contains per-request overrides for the options passed to the Synapse delete room API.
+type DeleteOptions struct {
+	Purge         *bool     `json:"purge,omitempty"`
+	Block         *bool     `json:"block,omitempty"`
+	NewRoomUserID id.UserID `json:"new_room_user_id,omitempty"`
+	RoomName      string    `json:"room_name,omitempty"`
+	Message       string    `json:"message,omitempty"`
+}
+
+// OrNil returns nil if none of the options are set, so that empty options aren't stored in queue items.
+func (opts *DeleteOptions) OrNil() *DeleteOptions {
+	if opts == nil || (opts.Purge == nil && opts.Block == nil && len(opts.NewRoomUserID) == 0 && len(opts.RoomName) == 0 && len(opts.Message) == 0) {
+		return nil
+	}
+	return opts
+}
+
+// HasReplacementRoomOptions returns true if any of the options for the room that local users are moved to are set.
+//
+// Those options let the caller create rooms and send messages as any local user,
+// so they're only accepted from admin API requests.
+func (opts *DeleteOptions) HasReplacementRoomOptions() bool {
+	return opts != nil && (len(opts.NewRoomUserID) > 0 || len(opts.RoomName) > 0 || len(opts.Message) > 0)
+}
+
 type LeavingRoom struct {
-	RoomID id.RoomID   `json:"roomID"`
-	Kick   []id.UserID `json:"kick"`
+	RoomID        id.RoomID      `json:"roomID"`
+	Owner         id.UserID      `json:"owner,omitempty"`
+	Kick          []id.UserID    `json:"kick"`
+	DeleteOptions *DeleteOptions `json:"deleteOptions,omitempty"`
+	// DueTime is when the room should be deleted. If it's zero, the room is deleted POSTPONE_DELETION after it's left.
+	DueTime time.Time `json:"dueTime,omitempty"`
+	// TraceContext is the OpenTelemetry trace context of the request that queued the room.
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+	// BridgeToken is the as_token of the bridge that queued the room, encrypted with QUEUE_ENCRYPTION_KEY.
+	// It's used to leave the room as the users to kick by masquerading instead of logging in as them.
+	BridgeToken string `json:"bridgeToken,omitempty"`
+	// DryRun is whether the room was queued in dry run mode. It's not stored in redis, as dry run mode uses separate queues.
+	DryRun bool `json:"-"`
+}
+
+// newBridgeLeavingRoom creates a leave queue item for a room queued by the bridge that the given client belongs to.
+//
+// If QUEUE_ENCRYPTION_KEY is set, the as_token of the client is stored in encrypted form.
+func newBridgeLeavingRoom(ctx context.Context, client *mautrix.Client, roomID id.RoomID, kick []id.UserID) *LeavingRoom {
+	leavingRoom := &LeavingRoom{RoomID: roomID, Owner: client.UserID, Kick: kick}
+	if len(kick) > 0 && canEncryptSecrets() {
+		var err error
+		if leavingRoom.BridgeToken, err = encryptSecret([]byte(client.AccessToken)); err != nil {
+			logFromContext(ctx).Warnfln("Failed to encrypt bridge token for %s: %v", roomID, err)
+		}
+	}
+	return leavingRoom
+}
+
+// getLeaveClient returns a client for leaving the room as the given user.
+//
+// If the room has a bridge token and the user is in the namespace of the bridge, the bridge masquerades as the user.
+// Otherwise, an access token is created for the user with the admin API.
+func getLeaveClient(ctx context.Context, leavingRoom *LeavingRoom, userID id.UserID) (*mautrix.Client, error) {
+	if len(leavingRoom.BridgeToken) == 0 {
+		return AdminLogin(ctx, userID)
+	}
+	reqLog := logFromContext(ctx)
+	token, err := decryptSecret(leavingRoom.BridgeToken)
+	if err != nil {
+		reqLog.Warnfln("Failed to decrypt bridge token to leave %s as %s, falling back to admin login: %v", leavingRoom.RoomID, userID, err)
+		return AdminLogin(ctx, userID)
+	}
+	bridgeClient, err := mautrix.NewClient(cfg.AsmuxURL, leavingRoom.Owner, string(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mautrix client: %w", err)
+	}
+	instrumentClient(bridgeClient)
+	client := masqueradeClient(bridgeClient, userID)
+	client.UserID = userID
+	var whoami mautrix.RespWhoami
+	_, err = client.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          client.BuildURL("account", "whoami"),
+		ResponseJSON: &whoami,
+		Context:      ctx,
+	})
+	if err != nil || whoami.UserID != userID {
+		reqLog.Debugfln("Can't masquerade as %s with the bridge token (%v), falling back to admin login", userID, err)
+		return AdminLogin(ctx, userID)
+	}
+	reqLog.Debugfln("Using bridge token to masquerade as %s", userID)
+	return client, nil
 }
 
 type PendingRoom struct {
-	RoomID    id.RoomID `json:"roomID"`
-	QueueTime time.Time `json:"queueTime"`
+	RoomID        id.RoomID      `json:"roomID"`
+	Owner         id.UserID      `json:"owner,omitempty"`
+	QueueTime     time.Time      `json:"queueTime"`
+	DeleteOptions *DeleteOptions `json:"deleteOptions,omitempty"`
+	// DueTime is when the room should be deleted. It's set to POSTPONE_DELETION after QueueTime if it's zero when pushing.
+	DueTime time.Time `json:"dueTime,omitempty"`
+	// Left and Blocked are set if the room went through the leave queue and if it was blocked there because of SOFT_DELETE.
+	Left    bool `json:"left,omitempty"`
+	Blocked bool `json:"blocked,omitempty"`
+	// TraceContext is the OpenTelemetry trace context of the leave stage or request that queued the room.
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+	// DryRun is whether the room was queued in dry run mode. It's not stored in redis, as dry run mode uses separate queues.
+	DryRun bool `json:"-"`
 }
 
-var queueLog = log.Sub("Queue")
+// makeDeleteRequest creates the delete room API request for the given room using the configured defaults and the per-room overrides.
+func makeDeleteRequest(pendingRoom *PendingRoom) ReqDeleteRoom {
+	req := ReqDeleteRoom{
+		RoomID:        pendingRoom.RoomID,
+		Purge:         true,
+		ForcePurge:    cfg.ForcePurge,
+		Block:         cfg.DeleteBlock,
+		NewRoomUserID: cfg.DeleteNewRoomUserID,
+		RoomName:      cfg.DeleteRoomName,
+		Message:       cfg.DeleteMessage,
+	}
+	if opts := pendingRoom.DeleteOptions; opts != nil {
+		if opts.Purge != nil {
+			req.Purge = *opts.Purge
+		}
+		if opts.Block != nil {
+			req.Block = *opts.Block
+		}
+		if len(opts.NewRoomUserID) > 0 {
+			req.NewRoomUserID = opts.NewRoomUserID
+		}
+		if len(opts.RoomName) > 0 {
+			req.RoomName = opts.RoomName
+		}
+		if len(opts.Message) > 0 {
+			req.Message = opts.Message
+		}
+	}
+	return req
+}
+
+var queueLog = newSubsystemLogger(SubsystemQueue, "Queue")
 var leaveQueue chan *LeavingRoom
-var deleteQueue chan id.RoomID
-var rds *redis.Client
-var leaveQueueKey = "yeetserv:leave_queue"
-var deleteQueueKey = "yeetserv:delete_queue"
-var pauseDeleteQueueKey = "yeetserv:pause_delete_queue"
-var errorQueueKey = "yeetserv:error_queue"
+var deleteSchedule *memorySchedule
+var rds redis.UniversalClient
+
+// redisCluster is true when using Redis Cluster, which requires hash tags in the queue keys.
+var redisCluster bool
+
+const leaveQueueKey = "yeetserv:leave_queue"
+
+// legacyDeleteQueueKey is the FIFO list used as the delete queue before rooms had individual due times.
+const legacyDeleteQueueKey = "yeetserv:delete_queue"
+
+// deleteScheduleKey is the sorted set of rooms waiting to be deleted, scored by their due time.
+const deleteScheduleKey = "yeetserv:delete_schedule"
+const pauseDeleteQueueKey = "yeetserv:pause_delete_queue"
+const errorQueueKey = "yeetserv:error_queue"
 
 var promLeaveQueueGauge = promauto.NewGauge(
 	prometheus.GaugeOpts{
@@ -95,35 +234,45 @@ var promLeaveQueuePostponeDurationGuage = promauto.NewGauge(
 	},
 )
 
-func initQueue() {
-	if len(cfg.RedisURL) > 0 {
-		log.Debugln("Initializing redis client")
-		redisURL, err := url.Parse(cfg.RedisURL)
-		if err != nil {
-			log.Fatalln("Bad redis URL:", err)
-			os.Exit(4)
+// queueKeyFor returns the redis key for the given queue. In dry run mode, the queues are kept separate from the real ones.
+//
+// With Redis Cluster, the yeetserv prefix is made a hash tag (e.g. `{yeetserv}:leave_queue`) so that all keys are
+// in the same slot, as some transactions and migrations use multiple keys.
+func queueKeyFor(key string, dryRun bool) string {
+	if redisCluster {
+		if prefix, rest, found := strings.Cut(key, ":"); found {
+			key = "{" + prefix + "}:" + rest
 		}
-		var opts redis.Options
-		opts.Addr = redisURL.Host
-		opts.Username = redisURL.User.Username()
-		opts.Password, _ = redisURL.User.Password()
-		rds = redis.NewClient(&opts)
+	}
+	if dryRun {
+		return strings.Replace(key, ":", ":dry_run:", 1)
+	}
+	return key
+}
 
-		if cfg.DryRun {
-			leaveQueueKey = strings.Replace(leaveQueueKey, ":", ":dry_run:", 1)
-			deleteQueueKey = strings.Replace(deleteQueueKey, ":", ":dry_run:", 1)
-			errorQueueKey = strings.Replace(errorQueueKey, ":", ":dry_run:", 1)
-		}
+// queueKey returns the redis key for the given queue in the dry run mode of the given context (see isDryRunContext).
+func queueKey(ctx context.Context, key string) string {
+	return queueKeyFor(key, isDryRunContext(ctx))
+}
 
-		log.Debugln("Redis leave queue key:", leaveQueueKey)
-		log.Debugln("Redis delete queue key:", deleteQueueKey)
-		log.Debugln("Redis error queue key:", errorQueueKey)
+func initQueue() {
+	if len(cfg.RedisURL) > 0 {
+		log.Debugfln("Initializing %s redis client", cfg.RedisOptions.Mode)
+		rds = newRedisClient(cfg.RedisOptions)
+		redisCluster = cfg.RedisOptions.Mode == RedisModeCluster
+
+		log.Debugln("Redis leave queue key:", queueKeyFor(leaveQueueKey, isDryRun()))
+		log.Debugln("Redis delete schedule key:", queueKeyFor(deleteScheduleKey, isDryRun()))
+		log.Debugln("Redis error queue key:", queueKeyFor(errorQueueKey, isDryRun()))
+		if err := migrateLegacyDeleteQueue(context.Background()); err != nil {
+			log.Errorln("Failed to migrate legacy delete queue:", err)
+		}
 	} else {
 		leaveQueue = make(chan *LeavingRoom, 8192)
-		deleteQueue = make(chan id.RoomID, 8192)
+		deleteSchedule = &memorySchedule{}
 	}
 
-	promLeaveQueuePostponeDurationGuage.Set(cfg.PostponeDeletion.Seconds())
+	promLeaveQueuePostponeDurationGuage.Set(getPostponeDeletion().Seconds())
 }
 
 func loopQueueStats(ctx context.Context, wg *sync.WaitGroup) {
@@ -131,14 +280,17 @@ func loopQueueStats(ctx context.Context, wg *sync.WaitGroup) {
 		return
 	}
 
+	setLoopRunning("queue_stats", true)
 	defer func() {
+		setLoopRunning("queue_stats", false)
 		queueLog.Infoln("Queue stats updater exiting")
 		wg.Done()
 	}()
 	for {
-		promLeaveQueueGauge.Set(float64(rds.LLen(ctx, leaveQueueKey).Val()))
-		promDeleteQueueGauge.Set(float64(rds.LLen(ctx, deleteQueueKey).Val()))
-		promErrorQueueGauge.Set(float64(rds.LLen(ctx, errorQueueKey).Val()))
+		promLeaveQueueGauge.Set(float64(rds.LLen(ctx, queueKey(ctx, leaveQueueKey)).Val()))
+		promDeleteQueueGauge.Set(float64(rds.ZCard(ctx, queueKey(ctx, deleteScheduleKey)).Val()))
+		promErrorQueueGauge.Set(float64(rds.LLen(ctx, queueKey(ctx, errorQueueKey)).Val()))
+		promMediaQueueGauge.Set(float64(rds.LLen(ctx, queueKey(ctx, mediaQueueKey)).Val()))
 		select {
 		case <-time.After(30 * time.Second):
 		case <-ctx.Done():
@@ -147,17 +299,19 @@ func loopQueueStats(ctx context.Context, wg *sync.WaitGroup) {
 	}
 }
 
-func PushLeaveQueue(ctx context.Context, roomID id.RoomID, usersToKick []id.UserID) error {
-	leavingRoom := &LeavingRoom{RoomID: roomID, Kick: usersToKick}
-
+func PushLeaveQueue(ctx context.Context, leavingRoom *LeavingRoom) error {
+	leavingRoom.DryRun = isDryRunContext(ctx)
+	if leavingRoom.TraceContext == nil {
+		leavingRoom.TraceContext = injectTraceContext(ctx)
+	}
 	if rds != nil {
-		jsonData, err := json.Marshal(leavingRoom)
+		data, err := encodeQueueItem(leavingRoom)
 		if err != nil {
-			return fmt.Errorf("failed to marshal %s to redis: %w", roomID, err)
+			return fmt.Errorf("failed to marshal %s to redis: %w", leavingRoom.RoomID, err)
 		}
-		err = rds.RPush(ctx, leaveQueueKey, jsonData).Err()
+		err = rds.RPush(ctx, queueKey(ctx, leaveQueueKey), data).Err()
 		if err != nil {
-			return fmt.Errorf("failed to push %s to redis: %w", roomID, err)
+			return fmt.Errorf("failed to push %s to redis: %w", leavingRoom.RoomID, err)
 		}
 	} else {
 		leaveQueue <- leavingRoom
@@ -166,26 +320,196 @@ func PushLeaveQueue(ctx context.Context, roomID id.RoomID, usersToKick []id.User
 	return nil
 }
 
-func PushDeleteQueue(ctx context.Context, roomID id.RoomID) error {
+func PushDeleteQueue(ctx context.Context, pendingRoom *PendingRoom) error {
+	pendingRoom.DryRun = isDryRunContext(ctx)
+	pendingRoom.QueueTime = time.Now()
+	if pendingRoom.DueTime.IsZero() {
+		pendingRoom.DueTime = pendingRoom.QueueTime.Add(getPostponeDeletion())
+	}
+	if pendingRoom.TraceContext == nil {
+		pendingRoom.TraceContext = injectTraceContext(ctx)
+	}
 	if rds != nil {
-		pendingRoom := &PendingRoom{RoomID: roomID, QueueTime: time.Now()}
-		jsonData, err := json.Marshal(pendingRoom)
+		return pushRedisSchedule(ctx, pendingRoom)
+	}
+	promDeleteQueueGauge.Set(float64(deleteSchedule.Push(pendingRoom)))
+	return nil
+}
+
+// encodeQueueItem converts a queue item to JSON for storing in redis.
+//
+// If QUEUE_ENCRYPTION_KEY is set, the JSON is encrypted so that redis doesn't contain tokens or user IDs in plaintext.
+func encodeQueueItem(item interface{}) (string, error) {
+	jsonData, err := json.Marshal(item)
+	if err != nil {
+		return "", err
+	} else if !canEncryptSecrets() {
+		return string(jsonData), nil
+	}
+	return encryptSecret(jsonData)
+}
+
+// decodeQueueItem parses a queue item from redis, which is either encrypted or plaintext JSON.
+func decodeQueueItem(item string, into interface{}) error {
+	data := []byte(item)
+	if isEncrypted(item) {
+		var err error
+		if data, err = decryptSecret(item); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, into)
+}
+
+// parseQueuedItem returns the room ID and owner of a raw redis queue entry, which is either a JSON object or a legacy plain room ID.
+//
+// Entries that can't be decrypted return an empty room ID.
+func parseQueuedItem(item string) (id.RoomID, id.UserID) {
+	var queued struct {
+		RoomID id.RoomID `json:"roomID"`
+		Owner  id.UserID `json:"owner"`
+	}
+	if err := decodeQueueItem(item, &queued); err != nil {
+		if isEncrypted(item) {
+			return "", ""
+		}
+		return id.RoomID(item), ""
+	}
+	return queued.RoomID, queued.Owner
+}
+
+// removeFromRedisQueue removes the given room from a redis queue and returns the owners of the removed entries.
+func removeFromRedisQueue(ctx context.Context, key string, roomID id.RoomID) ([]id.UserID, error) {
+	items, err := rds.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue from redis: %w", err)
+	}
+	var removedOwners []id.UserID
+	for _, item := range items {
+		itemRoomID, owner := parseQueuedItem(item)
+		if itemRoomID != roomID {
+			continue
+		}
+		count, err := rds.LRem(ctx, key, 1, item).Result()
 		if err != nil {
-			return fmt.Errorf("failed to marshal %s to redis: %w", roomID, err)
+			return removedOwners, fmt.Errorf("failed to remove %s from redis: %w", roomID, err)
+		} else if count > 0 {
+			removedOwners = append(removedOwners, owner)
+		}
+	}
+	return removedOwners, nil
+}
+
+// removeFromMemoryLeaveQueue removes the rooms that the given function returns true for from the in-memory leave queue.
+//
+// The other rooms are put back at the end of the queue, so rooms pushed in the meantime may end up before them.
+func removeFromMemoryLeaveQueue(match func(*LeavingRoom) bool) []*LeavingRoom {
+	var removed, kept []*LeavingRoom
+drain:
+	for i := len(leaveQueue); i > 0; i-- {
+		select {
+		case leavingRoom := <-leaveQueue:
+			if match(leavingRoom) {
+				removed = append(removed, leavingRoom)
+			} else {
+				kept = append(kept, leavingRoom)
+			}
+		default:
+			break drain
+		}
+	}
+	for _, leavingRoom := range kept {
+		leaveQueue <- leavingRoom
+	}
+	promLeaveQueueGauge.Set(float64(len(leaveQueue)))
+	return removed
+}
+
+// RemoveFromQueues removes the given room from the leave and delete queues and returns the removed entries.
+//
+// Entries removed from the leave queue are returned as PendingRooms that haven't been left or blocked yet.
+func RemoveFromQueues(ctx context.Context, roomID id.RoomID) ([]*PendingRoom, error) {
+	var leaveOwners []id.UserID
+	var removed []*PendingRoom
+	var err error
+	if rds != nil {
+		leaveOwners, err = removeFromRedisQueue(ctx, queueKey(ctx, leaveQueueKey), roomID)
+		if err == nil {
+			removed, err = removeFromRedisSchedule(ctx, roomID)
+		}
+	} else {
+		leavingRooms := removeFromMemoryLeaveQueue(func(leavingRoom *LeavingRoom) bool {
+			return leavingRoom.RoomID == roomID
+		})
+		for _, leavingRoom := range leavingRooms {
+			leaveOwners = append(leaveOwners, leavingRoom.Owner)
+		}
+		removed = deleteSchedule.Remove(roomID)
+		promDeleteQueueGauge.Set(float64(deleteSchedule.Len()))
+	}
+	for _, owner := range leaveOwners {
+		removed = append(removed, &PendingRoom{RoomID: roomID, Owner: owner})
+	}
+	for _, pendingRoom := range removed {
+		UntrackOwnerRoom(ctx, pendingRoom.Owner, roomID, AuditEventRestored, nil)
+	}
+	return removed, err
+}
+
+// removeOwnerFromRedisLeaveQueue removes all rooms of the given bridge bot from the redis leave queue.
+func removeOwnerFromRedisLeaveQueue(ctx context.Context, owner id.UserID) ([]*LeavingRoom, error) {
+	items, err := rds.LRange(ctx, queueKey(ctx, leaveQueueKey), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read leave queue from redis: %w", err)
+	}
+	var removed []*LeavingRoom
+	for _, item := range items {
+		leavingRoom := &LeavingRoom{}
+		if err = decodeQueueItem(item, leavingRoom); err != nil || leavingRoom.Owner != owner {
+			continue
 		}
-		err = rds.RPush(ctx, deleteQueueKey, jsonData).Err()
+		count, err := rds.LRem(ctx, queueKey(ctx, leaveQueueKey), 1, item).Result()
 		if err != nil {
-			return fmt.Errorf("failed to push %s to redis: %w", roomID, err)
+			return removed, fmt.Errorf("failed to remove %s from redis: %w", leavingRoom.RoomID, err)
+		} else if count > 0 {
+			removed = append(removed, leavingRoom)
+		}
+	}
+	return removed, nil
+}
+
+// RemoveOwnerFromQueues removes all rooms of the given bridge bot from the leave and delete queues.
+//
+// Legacy queue entries without an owner are not removed.
+func RemoveOwnerFromQueues(ctx context.Context, owner id.UserID) ([]*LeavingRoom, []*PendingRoom, error) {
+	var leavingRooms []*LeavingRoom
+	var pendingRooms []*PendingRoom
+	var err error
+	if rds != nil {
+		leavingRooms, err = removeOwnerFromRedisLeaveQueue(ctx, owner)
+		if err == nil {
+			pendingRooms, err = removeOwnerFromRedisSchedule(ctx, owner)
 		}
 	} else {
-		deleteQueue <- roomID
-		promDeleteQueueGauge.Set(float64(len(deleteQueue)))
+		leavingRooms = removeFromMemoryLeaveQueue(func(leavingRoom *LeavingRoom) bool {
+			return leavingRoom.Owner == owner
+		})
+		pendingRooms = deleteSchedule.RemoveOwner(owner)
+		promDeleteQueueGauge.Set(float64(deleteSchedule.Len()))
 	}
-	return nil
+	for _, leavingRoom := range leavingRooms {
+		UntrackOwnerRoom(ctx, owner, leavingRoom.RoomID, AuditEventRestored, nil)
+	}
+	for _, pendingRoom := range pendingRooms {
+		UntrackOwnerRoom(ctx, owner, pendingRoom.RoomID, AuditEventRestored, nil)
+	}
+	return leavingRooms, pendingRooms, err
 }
 
 func loopLeaveQueue(ctx context.Context, wg *sync.WaitGroup) {
+	setLoopRunning("leave", true)
 	defer func() {
+		setLoopRunning("leave", false)
 		queueLog.Infoln("Queue leave loop exiting")
 		wg.Done()
 	}()
@@ -207,36 +531,54 @@ func loopLeaveQueue(ctx context.Context, wg *sync.WaitGroup) {
 }
 
 func loopDeleteQueue(ctx context.Context, wg *sync.WaitGroup) {
+	setLoopRunning("delete", true)
 	defer func() {
+		setLoopRunning("delete", false)
 		queueLog.Infoln("Queue delete loop exiting")
 		wg.Done()
 	}()
 	for {
 		consumeDeleteQueue(ctx)
 		select {
-		case <-time.After(cfg.QueueSleep):
+		case <-time.After(getQueueSleep()):
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func pushErrorQueue(roomID id.RoomID) {
-	if rds == nil {
-		return
+// memoryErrorQueueLength is the number of rooms that have failed since startup when not using redis.
+var memoryErrorQueueLength int64
+
+// pushErrorQueue marks the room as failed in redis, sends the room errored webhook and stops counting it as pending for its owner.
+func pushErrorQueue(pendingRoom *PendingRoom, roomErr error) {
+	ctx := contextWithDryRun(context.Background(), pendingRoom.DryRun)
+	var errorQueueLength int64
+	if rds != nil {
+		queueLog.Debugln("Marking", pendingRoom.RoomID, "as errored in redis")
+		var err error
+		errorQueueLength, err = rds.RPush(ctx, queueKey(ctx, errorQueueKey), pendingRoom.RoomID.String()).Result()
+		if err != nil {
+			queueLog.Errorfln("Failed to mark %s as errored in redis: %v", pendingRoom.RoomID, err)
+		}
+	} else {
+		errorQueueLength = atomic.AddInt64(&memoryErrorQueueLength, 1)
+		promErrorQueueGauge.Set(float64(errorQueueLength))
 	}
-	queueLog.Debugln("Marking", roomID, "as errored in redis")
-	ctx := context.Background()
-	err := rds.RPush(ctx, errorQueueKey, roomID.String()).Err()
-	if err != nil {
-		queueLog.Errorln("Failed to mark %s as errored in redis: %v", roomID, err)
-		return
+	SendWebhook(ctx, WebhookRoomErrored, WebhookPayload{
+		Owner:  pendingRoom.Owner,
+		RoomID: pendingRoom.RoomID,
+		Error:  roomErr.Error(),
+	})
+	if cfg.WebhookErrorQueueThreshold > 0 && errorQueueLength == cfg.WebhookErrorQueueThreshold {
+		SendWebhook(ctx, WebhookErrorQueueThreshold, WebhookPayload{ErrorQueueLength: errorQueueLength})
 	}
+	UntrackOwnerRoom(ctx, pendingRoom.Owner, pendingRoom.RoomID, AuditEventFailed, roomErr)
 }
 
 func popLeaveQueue(ctx context.Context) (*LeavingRoom, bool) {
 	if rds != nil {
-		nextItem, err := rds.BLPop(ctx, 0, leaveQueueKey).Result()
+		nextItem, err := rds.BLPop(ctx, 0, queueKey(ctx, leaveQueueKey)).Result()
 		if err != nil {
 			if !errors.Is(err, context.Canceled) {
 				queueLog.Errorln("Failed to get next leave item from redis:", err)
@@ -245,11 +587,18 @@ func popLeaveQueue(ctx context.Context) (*LeavingRoom, bool) {
 		}
 
 		leavingRoom := &LeavingRoom{}
-		if err := json.Unmarshal([]byte(nextItem[1]), leavingRoom); err != nil {
+		if err := decodeQueueItem(nextItem[1], leavingRoom); err != nil {
 			queueLog.Errorln("Failed to unmarshal next leave item from redis:", err)
+			if isEncrypted(nextItem[1]) {
+				// Keep items encrypted with an unknown key in case the key is added back to QUEUE_ENCRYPTION_OLD_KEYS
+				if err = rds.RPush(ctx, queueKey(ctx, leaveQueueKey), nextItem[1]).Err(); err != nil {
+					queueLog.Errorln("Failed to put encrypted leave item back to redis:", err)
+				}
+			}
 			return nil, false
 		}
 
+		leavingRoom.DryRun = isDryRunContext(ctx)
 		return leavingRoom, true
 	} else {
 		select {
@@ -264,119 +613,196 @@ func popLeaveQueue(ctx context.Context) (*LeavingRoom, bool) {
 }
 
 func consumeLeaveQueue(ctx context.Context) bool {
+	waitForMaintenanceWindow(ctx, "leave", getLeaveWindows)
 	leavingRoom, ok := popLeaveQueue(ctx)
 	if !ok {
 		return false
 	}
-	if cfg.DryRun {
-		queueLog.Debugfln("Not requesting admin API to leave room %s (dry run)", leavingRoom.RoomID)
+	leaveLog := roomLogger(queueLog, leavingRoom.RoomID, leavingRoom.Owner, StageLeave)
+	if leavingRoom.DryRun {
+		leaveLog.Debugfln("Not requesting admin API to leave room %s (dry run)", leavingRoom.RoomID)
 	} else {
-		queueLog.Debugfln("Requesting admin API to leave room %s", leavingRoom.RoomID)
+		leaveLog.Debugfln("Requesting admin API to leave room %s", leavingRoom.RoomID)
 	}
 	startTime := time.Now()
-	adminContext := context.WithValue(ctx, logContextKey, queueLog)
+	ctx, span := startSpan(extractTraceContext(ctx, leavingRoom.TraceContext), "leave_room", leavingRoom.RoomID, leavingRoom.Owner)
+	defer span.End()
+	ctx = contextWithDryRun(contextWithLog(ctx, leaveLog), leavingRoom.DryRun)
+
+	if cfg.FarewellTemplate != nil && len(leavingRoom.Owner) > 0 {
+		farewellCtx, farewellSpan := startSpan(ctx, "send_farewell", leavingRoom.RoomID, leavingRoom.Owner)
+		err := SendFarewell(farewellCtx, leavingRoom)
+		endSpan(farewellSpan, err)
+		if err != nil {
+			leaveLog.Warnfln("Failed to send farewell notice to %s: %v", leavingRoom.RoomID, err)
+		}
+	}
 
+	var kickedUsers []id.UserID
+	var removedAliases []id.RoomAlias
 	for _, userID := range leavingRoom.Kick {
-		if userClient, err := AdminLogin(adminContext, userID); err != nil {
-			queueLog.Warnfln("Failed to log in as %s to leave %s: %v", userID, leavingRoom.RoomID, err)
-		} else if cfg.DryRun {
-			queueLog.Debugfln("Not leaving %s as %s as we're in dry run mode", leavingRoom.RoomID, userID)
+		userCtx, userSpan := startSpan(ctx, "leave_as_user", leavingRoom.RoomID, leavingRoom.Owner)
+		userSpan.SetAttributes(attribute.String("user_id", userID.String()))
+		userClient, err := getLeaveClient(userCtx, leavingRoom, userID)
+		if err != nil {
+			leaveLog.Warnfln("Failed to log in as %s to leave %s: %v", userID, leavingRoom.RoomID, err)
+		} else if leavingRoom.DryRun {
+			leaveLog.Debugfln("Not leaving %s as %s as we're in dry run mode", leavingRoom.RoomID, userID)
 		} else if _, err = userClient.LeaveRoom(leavingRoom.RoomID); err != nil {
-			queueLog.Warnfln("Failed to leave %s as %s: %w", leavingRoom.RoomID, userID, err)
+			leaveLog.Warnfln("Failed to leave %s as %s: %v", leavingRoom.RoomID, userID, err)
 		} else {
-			queueLog.Debugfln("Successfully left %s as %s", leavingRoom.RoomID, userID)
+			leaveLog.Debugfln("Successfully left %s as %s", leavingRoom.RoomID, userID)
+			kickedUsers = append(kickedUsers, userID)
 		}
+		if logoutErr := LogoutAdminLogin(userCtx, userID); logoutErr != nil {
+			leaveLog.Warnfln("Failed to log out %s after leaving %s: %v", userID, leavingRoom.RoomID, logoutErr)
+		}
+		endSpan(userSpan, err)
 	}
 
+	_, aliasSpan := startSpan(ctx, "remove_aliases", leavingRoom.RoomID, leavingRoom.Owner)
 	aliases, err := adminClient.GetAliases(leavingRoom.RoomID)
 	if aliases != nil {
+		aliasLog := leaveLog.With(LogFields{"stage": StageAlias})
 		for _, alias := range aliases.Aliases {
-			if cfg.DryRun {
-				queueLog.Debugfln("Not removing alias %s of %s as we're in dry run mode", alias, leavingRoom.RoomID)
+			if leavingRoom.DryRun {
+				aliasLog.Debugfln("Not removing alias %s of %s as we're in dry run mode", alias, leavingRoom.RoomID)
 			} else {
-				if _, deleteErr := asmuxClient.DeleteAlias(alias); deleteErr != nil {
-					queueLog.Warnfln("Failed to remove alias %s of %s: %v", alias, leavingRoom.RoomID, deleteErr)
+				_, deleteErr := asmuxClient.DeleteAlias(alias)
+				observeStageError(leavingRoom.Owner, StageAlias, deleteErr)
+				if deleteErr != nil {
+					aliasLog.Warnfln("Failed to remove alias %s of %s: %v", alias, leavingRoom.RoomID, deleteErr)
 				} else {
-					queueLog.Debugfln("Successfully removed alias %s of %s", alias, leavingRoom.RoomID)
+					aliasLog.Debugfln("Successfully removed alias %s of %s", alias, leavingRoom.RoomID)
+					removedAliases = append(removedAliases, alias)
 				}
 			}
 		}
 	}
+	endSpan(aliasSpan, err)
+
+	blocked := false
+	if err == nil && cfg.SoftDelete {
+		if leavingRoom.DryRun {
+			leaveLog.Debugfln("Not blocking %s as we're in dry run mode", leavingRoom.RoomID)
+		} else if blockErr := adminBlockRoom(ctx, ReqBlockRoom{RoomID: leavingRoom.RoomID, Block: true}); blockErr != nil {
+			// The users have already left, so move on to the delete queue instead of repeating the leave
+			recordSpanError(span, blockErr)
+			leaveLog.Warnfln("Failed to block %s, moving it to the delete queue unblocked: %v", leavingRoom.RoomID, blockErr)
+		} else {
+			blocked = true
+			leaveLog.Debugfln("Successfully blocked %s", leavingRoom.RoomID)
+			if dirErr := adminRemoveFromDirectory(ctx, leavingRoom.RoomID); dirErr != nil {
+				leaveLog.Warnfln("Failed to remove %s from the room directory: %v", leavingRoom.RoomID, dirErr)
+			}
+		}
+	}
 
 	if err == nil {
-		err = PushDeleteQueue(context.Background(), leavingRoom.RoomID)
+		err = PushDeleteQueue(detachContext(ctx), &PendingRoom{
+			RoomID:        leavingRoom.RoomID,
+			Owner:         leavingRoom.Owner,
+			DeleteOptions: leavingRoom.DeleteOptions,
+			DueTime:       leavingRoom.DueTime,
+			Left:          true,
+			Blocked:       blocked,
+		})
 	}
 
+	observeStageError(leavingRoom.Owner, StageLeave, err)
+	recordSpanError(span, err)
 	if err != nil {
-		queueLog.Warnfln("Failed to push %s to delete queue: %w", leavingRoom.RoomID, err)
+		leaveLog.Warnfln("Failed to push %s to delete queue: %v", leavingRoom.RoomID, err)
 
-		if err = PushLeaveQueue(ctx, leavingRoom.RoomID, leavingRoom.Kick); err != nil {
-			queueLog.Errorfln("Failed to put room %s back to leave queue: %v", leavingRoom.RoomID, err)
+		if err = PushLeaveQueue(ctx, leavingRoom); err != nil {
+			leaveLog.Errorfln("Failed to put room %s back to leave queue: %v", leavingRoom.RoomID, err)
 		}
 		return false
 	} else {
 		leaveTime := time.Now().Sub(startTime)
-		queueLog.Debugln("Room", leavingRoom.RoomID, "successfully left in", leaveTime, "and moved to delete queue")
+		leaveLog.With(LogFields{"duration_ms": leaveTime.Milliseconds()}).
+			Debugln("Room", leavingRoom.RoomID, "successfully left in", leaveTime, "and moved to delete queue")
+		WriteAudit(ctx, AuditEntry{
+			Event:          AuditEventLeft,
+			RoomID:         leavingRoom.RoomID,
+			Owner:          leavingRoom.Owner,
+			KickedUsers:    kickedUsers,
+			RemovedAliases: removedAliases,
+			Blocked:        blocked,
+			DurationMS:     leaveTime.Milliseconds(),
+		})
 		promLeaveCounter.Add(1)
 		promLeaveSeconds.Observe(leaveTime.Seconds())
 		return true
 	}
 }
 
-func popDeleteQueue(ctx context.Context) (id.RoomID, bool) {
+// peekDeleteQueue returns the room in the delete queue with the earliest due time without removing it.
+//
+// Legacy plain room ID items are returned without a queue time. If the queue is empty, nil is returned.
+func peekDeleteQueue(ctx context.Context) (*PendingRoom, error) {
 	if rds != nil {
-		nextItem, err := rds.LRange(ctx, deleteQueueKey, 0, 0).Result()
-		if err != nil {
-			queueLog.Errorln("Failed to peek next item from redis:", err)
-			return "", false
-		}
-
-		if len(nextItem) == 0 {
-			return "", false
-		}
-
-		// we only check for due if we get valid json, otherwise it's a legacy plain room id OR requeued error room ID
-		pendingRoom := &PendingRoom{}
-		if err := json.Unmarshal([]byte(nextItem[0]), pendingRoom); err == nil {
-			sinceQueueTime := time.Since(pendingRoom.QueueTime)
-			promLeaveQueueNextAgeGauge.Set(sinceQueueTime.Seconds())
-
-			if sinceQueueTime < cfg.PostponeDeletion {
-				queueLog.Debugfln("Next item from delete queue is due on %v", pendingRoom.QueueTime.Add(cfg.PostponeDeletion))
-				return "", false
-			}
-		}
+		return peekRedisSchedule(ctx)
+	}
+	return deleteSchedule.Peek(), nil
+}
 
-		// really pop it now, we assume no one pushes to the head of the queue
-		nextItem, err = rds.BLPop(ctx, 0, deleteQueueKey).Result()
+func popDeleteQueue(ctx context.Context) (*PendingRoom, bool) {
+	var pendingRoom *PendingRoom
+	if rds != nil {
+		var err error
+		pendingRoom, err = popRedisSchedule(ctx)
 		if err != nil {
 			if !errors.Is(err, context.Canceled) {
 				queueLog.Errorln("Failed to get next item from redis:", err)
 			}
-			return "", false
-		}
-
-		if err := json.Unmarshal([]byte(nextItem[1]), pendingRoom); err == nil {
-			return pendingRoom.RoomID, true
+			return nil, false
 		}
-
-		return id.RoomID(nextItem[1]), true
 	} else {
-		select {
-		case roomID := <-deleteQueue:
-			promDeleteQueueGauge.Set(float64(len(deleteQueue)))
-			return roomID, true
-		case <-ctx.Done():
-			promDeleteQueueGauge.Set(0)
-			return "", false
+		var remaining int
+		pendingRoom, remaining = deleteSchedule.PopDue()
+		promDeleteQueueGauge.Set(float64(remaining))
+	}
+	if pendingRoom == nil {
+		if next, err := peekDeleteQueue(ctx); err == nil && next != nil {
+			promLeaveQueueNextAgeGauge.Set(time.Since(next.QueueTime).Seconds())
+			queueLog.Debugfln("Next item from delete queue is due on %v", next.DueTime)
 		}
+		return nil, false
+	}
+	if !pendingRoom.QueueTime.IsZero() {
+		promLeaveQueueNextAgeGauge.Set(time.Since(pendingRoom.QueueTime).Seconds())
 	}
+	return pendingRoom, true
+}
+
+// pendingQueueTime returns a pointer to the queue time of the given room, or nil for legacy queue items without a timestamp.
+func pendingQueueTime(pendingRoom *PendingRoom) *time.Time {
+	if pendingRoom.QueueTime.IsZero() {
+		return nil
+	}
+	return &pendingRoom.QueueTime
+}
+
+// isDeletePaused returns true if the delete queue has been paused by setting the pause key in redis.
+func isDeletePaused(ctx context.Context) bool {
+	paused, err := rds.Get(ctx, pauseDeleteQueueKey).Result()
+	return err == nil || paused != ""
+}
+
+// SetDeletePaused pauses or resumes the delete queue by setting or removing the pause key in redis.
+func SetDeletePaused(ctx context.Context, paused bool) error {
+	if rds == nil {
+		return fmt.Errorf("pausing the delete queue requires redis")
+	} else if paused {
+		return rds.Set(ctx, pauseDeleteQueueKey, "1", 0).Err()
+	}
+	return rds.Del(ctx, pauseDeleteQueueKey).Err()
 }
 
 func waitIfDeletePaused(ctx context.Context) {
 	for {
-		paused, err := rds.Get(ctx, pauseDeleteQueueKey).Result()
-		if err != nil && paused == "" {
+		if !isDeletePaused(ctx) {
 			return
 		}
 		queueLog.Debugln("Waiting, deletes currently paused")
@@ -388,39 +814,95 @@ func consumeDeleteQueue(ctx context.Context) {
 	if rds != nil {
 		waitIfDeletePaused(ctx)
 	}
+	waitForMaintenanceWindow(ctx, "delete", getDeleteWindows)
 
-	roomID, ok := popDeleteQueue(ctx)
+	pendingRoom, ok := popDeleteQueue(ctx)
 	if !ok {
 		return
 	}
-	if cfg.DryRun {
-		queueLog.Debugfln("Not requesting admin API to clean up room %s (dry run)", roomID)
+	roomID := pendingRoom.RoomID
+	ctx, span := startSpan(extractTraceContext(ctx, pendingRoom.TraceContext), "delete_room", roomID, pendingRoom.Owner)
+	defer span.End()
+	deleteLog := roomLogger(queueLog, roomID, pendingRoom.Owner, StageDelete)
+	ctx = contextWithDryRun(contextWithLog(ctx, deleteLog), pendingRoom.DryRun)
+	if pendingRoom.DryRun {
+		deleteLog.Debugfln("Not requesting admin API to clean up room %s (dry run)", roomID)
 	} else {
-		queueLog.Debugfln("Requesting admin API to clean up room %s", roomID)
+		deleteLog.Debugfln("Requesting admin API to clean up room %s", roomID)
 	}
 	startTime := time.Now()
+	if snapshotEnabled() {
+		deleteLog.Debugln("Saving snapshot of room", roomID, "before deleting it")
+		snapshotCtx, snapshotSpan := startSpan(ctx, "snapshot_room", roomID, pendingRoom.Owner)
+		err := SnapshotRoom(snapshotCtx, pendingRoom)
+		endSpan(snapshotSpan, err)
+		if err != nil {
+			recordSpanError(span, err)
+			deleteLog.Warnfln("Failed to save snapshot of %s, not deleting it: %v", roomID, err)
+			observeStage(pendingRoom.Owner, StageDelete, OutcomeError)
+			go pushErrorQueue(pendingRoom, fmt.Errorf("failed to save snapshot: %w", err))
+			WriteAudit(ctx, AuditEntry{
+				Event:      AuditEventFailed,
+				RoomID:     roomID,
+				Owner:      pendingRoom.Owner,
+				QueueTime:  pendingQueueTime(pendingRoom),
+				DurationMS: time.Since(startTime).Milliseconds(),
+				Error:      fmt.Sprintf("failed to save snapshot: %v", err),
+			})
+			return
+		}
+	}
 	if len(cfg.AsmuxAccessToken) > 0 && cfg.AsmuxMainURL != nil {
-		queueLog.Debugln("Requesting asmux to forget about room", roomID)
-		err := asmuxDeleteRoom(ctx, roomID)
+		asmuxLog := deleteLog.With(LogFields{"stage": StageAsmuxForget})
+		asmuxLog.Debugln("Requesting asmux to forget about room", roomID)
+		asmuxCtx, asmuxSpan := startSpan(ctx, "asmux_forget", roomID, pendingRoom.Owner)
+		err := asmuxDeleteRoom(asmuxCtx, roomID)
+		endSpan(asmuxSpan, err)
+		observeStageError(pendingRoom.Owner, StageAsmuxForget, err)
 		if err != nil {
-			queueLog.Warnfln("Failed to request asmux to forget about room %s: %v", roomID, err)
+			asmuxLog.Warnfln("Failed to request asmux to forget about room %s: %v", roomID, err)
 		}
 	}
-	_, err := adminDeleteRoom(ctx, ReqDeleteRoom{RoomID: roomID, Purge: true, ForcePurge: cfg.ForcePurge})
+	resp, err := adminDeleteRoom(ctx, makeDeleteRequest(pendingRoom))
+	observeStageError(pendingRoom.Owner, StageDelete, err)
+	recordSpanError(span, err)
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
-			queueLog.Debugfln("Context was canceled while cleaning up %s, putting it back in the queue", roomID)
-			err = PushDeleteQueue(context.Background(), roomID)
+			deleteLog.Debugfln("Context was canceled while cleaning up %s, putting it back in the queue", roomID)
+			err = PushDeleteQueue(detachContext(ctx), pendingRoom)
 			if err != nil {
-				queueLog.Errorfln("Failed to put %s back in the queue: %v", roomID, err)
+				deleteLog.Errorfln("Failed to put %s back in the queue: %v", roomID, err)
 			}
 		} else {
-			queueLog.Warnfln("Failed to clean up %s: %v", roomID, err)
-			go pushErrorQueue(roomID)
+			deleteLog.With(LogFields{"duration_ms": time.Since(startTime).Milliseconds()}).
+				Warnfln("Failed to clean up %s: %v", roomID, err)
+			go pushErrorQueue(pendingRoom, err)
+			WriteAudit(ctx, AuditEntry{
+				Event:      AuditEventFailed,
+				RoomID:     roomID,
+				Owner:      pendingRoom.Owner,
+				QueueTime:  pendingQueueTime(pendingRoom),
+				DurationMS: time.Since(startTime).Milliseconds(),
+				Error:      err.Error(),
+			})
 		}
 	} else {
 		deleteTime := time.Now().Sub(startTime)
-		queueLog.Debugln("Room", roomID, "successfully cleaned up in", deleteTime)
+		deleteLog.With(LogFields{"duration_ms": deleteTime.Milliseconds()}).
+			Debugln("Room", roomID, "successfully cleaned up in", deleteTime)
+		markDeleteSuccess()
+		UntrackOwnerRoom(detachContext(ctx), pendingRoom.Owner, roomID, AuditEventDeleted, nil)
+		if len(resp.NewRoomID) > 0 {
+			deleteLog.Debugfln("Local users of %s were moved to %s", roomID, resp.NewRoomID)
+		}
+		WriteAudit(ctx, AuditEntry{
+			Event:          AuditEventDeleted,
+			RoomID:         roomID,
+			Owner:          pendingRoom.Owner,
+			DeleteResponse: resp,
+			QueueTime:      pendingQueueTime(pendingRoom),
+			DurationMS:     deleteTime.Milliseconds(),
+		})
 		promDeleteCounter.Add(1)
 		promDeleteSeconds.Observe(deleteTime.Seconds())
 	}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// FarewellTemplateData is the data available in the FAREWELL_MESSAGE template.
+type FarewellTemplateData struct {
+	BridgeName string
+	Owner      id.UserID
+	RoomID     id.RoomID
+	DeleteTime time.Time
+	SupportURL string
+}
+
+// farewellLock is the mutex used to rate limit farewell notices.
+var farewellLock sync.Mutex
+
+// lastFarewell is the time when the previous farewell notice was sent.
+var lastFarewell time.Time
+
+// waitFarewellRateLimit blocks until FAREWELL_INTERVAL has passed since the previous farewell notice.
+func waitFarewellRateLimit(ctx context.Context) error {
+	farewellLock.Lock()
+	defer farewellLock.Unlock()
+	if wait := time.Until(lastFarewell.Add(cfg.FarewellInterval)); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	lastFarewell = time.Now()
+	return nil
+}
+
+// SendFarewell sends the FAREWELL_MESSAGE notice into a room before the bridge user is removed from it.
+//
+// The notice is sent as the bridge bot if it's in the room, or as a bridge ghost otherwise.
+func SendFarewell(ctx context.Context, leavingRoom *LeavingRoom) error {
+	bridgeUserLocalpart, bridgeName, _, err := parseBridgeName(leavingRoom.Owner)
+	if err != nil {
+		return err
+	}
+	members, err := adminListRoomMembers(ctx, leavingRoom.RoomID)
+	if err != nil {
+		return fmt.Errorf("failed to get members: %w", err)
+	}
+	bridgeGhostPrefix := fmt.Sprintf("@_%s_%s_", bridgeUserLocalpart, bridgeName)
+	var sender id.UserID
+	for _, member := range members {
+		if member == leavingRoom.Owner {
+			sender = member
+			break
+		} else if len(sender) == 0 && strings.HasPrefix(member.String(), bridgeGhostPrefix) {
+			sender = member
+		}
+	}
+	if len(sender) == 0 {
+		return fmt.Errorf("neither the bridge bot nor any bridge ghosts are in the room")
+	}
+
+	deleteTime := leavingRoom.DueTime
+	if deleteTime.IsZero() {
+		deleteTime = time.Now().Add(getPostponeDeletion())
+	}
+	var text strings.Builder
+	err = cfg.FarewellTemplate.Execute(&text, &FarewellTemplateData{
+		BridgeName: bridgeName,
+		Owner:      leavingRoom.Owner,
+		RoomID:     leavingRoom.RoomID,
+		DeleteTime: deleteTime,
+		SupportURL: cfg.FarewellSupportURL,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to render template: %w", err)
+	}
+
+	if isDryRunContext(ctx) {
+		logFromContext(ctx).Debugfln("Not sending farewell notice to %s as %s as we're in dry run mode", leavingRoom.RoomID, sender)
+		return nil
+	} else if err = waitFarewellRateLimit(ctx); err != nil {
+		return err
+	}
+	_, err = masqueradeClient(asmuxClient, sender).SendNotice(leavingRoom.RoomID, text.String())
+	if err != nil {
+		return fmt.Errorf("failed to send notice as %s: %w", sender, err)
+	}
+	logFromContext(ctx).Debugfln("Sent farewell notice to %s as %s", leavingRoom.RoomID, sender)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"maunium.net/go/mautrix/id"
+)
+
+// GhostReport is the result of deactivating the ghost users of a bridge.
+type GhostReport struct {
+	Owner  id.UserID `json:"owner"`
+	DryRun bool      `json:"dry_run"`
+	// Deactivated contains the ghosts that were deactivated, or would have been deactivated in dry run mode.
+	Deactivated []id.UserID `json:"deactivated"`
+	// InRooms contains the ghosts that were skipped because they're still in some rooms.
+	InRooms []id.UserID `json:"in_rooms"`
+	// Failed contains the ghosts whose rooms couldn't be listed or that couldn't be deactivated.
+	Failed []id.UserID `json:"failed"`
+}
+
+var ghostLog = newSubsystemLogger(SubsystemQueue, "Ghosts")
+
+var promGhostCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "yeetserv_ghost_deactivations_total",
+		Help: "Number of bridge ghost users processed after the rooms of a bridge were deleted",
+	},
+	[]string{"bridge", "outcome"},
+)
+
+// ghostJobsLock is the mutex used to lock reading/writing the ghostJobs map.
+var ghostJobsLock sync.Mutex
+
+// ghostJobs contains the bridge bots whose ghosts are currently being deactivated.
+var ghostJobs = make(map[id.UserID]struct{})
+
+// listBridgeGhosts returns all users whose localpart starts with the ghost prefix of the given bridge bot.
+//
+// The bridge bot itself is not included. Deactivated users are only included if includeDeactivated is true.
+func listBridgeGhosts(ctx context.Context, owner id.UserID, includeDeactivated bool) ([]id.UserID, error) {
+	bridgeUserLocalpart, bridgeName, homeserver, err := parseBridgeName(owner)
+	if err != nil {
+		return nil, err
+	}
+	ghostPrefix := fmt.Sprintf("_%s_%s_", bridgeUserLocalpart, bridgeName)
+	var ghosts []id.UserID
+	from := ""
+	for {
+		resp, err := adminListUsers(ctx, ghostPrefix, from, includeDeactivated)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range resp.Users {
+			// The name filter also matches display names and the middle of localparts, so check the prefix again.
+			localpart, userHomeserver, err := user.Name.Parse()
+			if err != nil || (user.Deactivated && !includeDeactivated) || user.Name == owner || userHomeserver != homeserver || !strings.HasPrefix(localpart, ghostPrefix) {
+				continue
+			}
+			ghosts = append(ghosts, user.Name)
+		}
+		if resp.NextToken == nil {
+			return ghosts, nil
+		}
+		from = fmt.Sprint(resp.NextToken)
+	}
+}
+
+// DeactivateGhosts deactivates and erases all ghost users of the given bridge bot that aren't in any rooms anymore.
+//
+// Deactivations are spaced out by DEACTIVATE_GHOSTS_INTERVAL. In dry run mode, only the report is made.
+func DeactivateGhosts(ctx context.Context, owner id.UserID, dryRun bool) (*GhostReport, error) {
+	report := &GhostReport{
+		Owner:       owner,
+		DryRun:      dryRun,
+		Deactivated: []id.UserID{},
+		InRooms:     []id.UserID{},
+		Failed:      []id.UserID{},
+	}
+	ghosts, err := listBridgeGhosts(ctx, owner, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ghosts of %s: %w", owner, err)
+	}
+	ghostLog.Debugfln("Found %d ghosts of %s", len(ghosts), owner)
+	bridge := bridgeLabel(owner)
+	throttle := false
+	for _, ghost := range ghosts {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		rooms, err := adminListUserRooms(ctx, ghost)
+		if err != nil {
+			ghostLog.Warnfln("Failed to list rooms of %s: %v", ghost, err)
+			report.Failed = append(report.Failed, ghost)
+			promGhostCounter.WithLabelValues(bridge, string(OutcomeError)).Inc()
+			continue
+		} else if len(rooms) > 0 {
+			ghostLog.Debugfln("Not deactivating %s as it's still in %d rooms", ghost, len(rooms))
+			report.InRooms = append(report.InRooms, ghost)
+			promGhostCounter.WithLabelValues(bridge, string(OutcomeRejected)).Inc()
+			continue
+		} else if dryRun {
+			report.Deactivated = append(report.Deactivated, ghost)
+			continue
+		}
+		if throttle {
+			select {
+			case <-time.After(cfg.DeactivateGhostsInterval):
+			case <-ctx.Done():
+				return report, ctx.Err()
+			}
+		}
+		throttle = true
+		err = adminDeactivateUser(ctx, ReqDeactivateUser{UserID: ghost, Erase: true})
+		if err != nil {
+			ghostLog.Warnfln("Failed to deactivate %s: %v", ghost, err)
+			report.Failed = append(report.Failed, ghost)
+			promGhostCounter.WithLabelValues(bridge, string(OutcomeError)).Inc()
+		} else {
+			ghostLog.Debugfln("Deactivated %s", ghost)
+			report.Deactivated = append(report.Deactivated, ghost)
+			promGhostCounter.WithLabelValues(bridge, string(OutcomeSuccess)).Inc()
+		}
+	}
+	return report, nil
+}
+
+// deactivateGhostsAfterDrain deactivates the ghosts of the given bridge bot in the background
+// if DEACTIVATE_GHOSTS is enabled and the whole bridge was cleaned up.
+//
+// Drains of rooms queued individually with the queue endpoint never deactivate ghosts, as the bridge may still be running.
+func deactivateGhostsAfterDrain(ctx context.Context, owner id.UserID, summary *OwnerSummary) {
+	if !cfg.DeactivateGhosts || !summary.isTeardown() {
+		return
+	}
+	if !StartGhostDeactivation(ctx, owner) {
+		ghostLog.Debugfln("Not starting ghost deactivation of %s as it's already running or yeetserv is shutting down", owner)
+	}
+}
+
+// StartGhostDeactivation starts deactivating the ghosts of the given bridge bot in the background
+// in the dry run mode of the given context. The report is logged and sent as the ghosts.deactivated webhook.
+// The deactivation is stopped on shutdown, and shutdown waits for it to stop.
+//
+// It returns false if the ghosts of the bridge bot are already being deactivated or yeetserv is shutting down.
+func StartGhostDeactivation(ctx context.Context, owner id.UserID) bool {
+	ghostJobsLock.Lock()
+	defer ghostJobsLock.Unlock()
+	if _, running := ghostJobs[owner]; running {
+		return false
+	}
+	started := goBackground(ctx, func(ctx context.Context) {
+		defer func() {
+			ghostJobsLock.Lock()
+			delete(ghostJobs, owner)
+			ghostJobsLock.Unlock()
+		}()
+		report, err := DeactivateGhosts(ctx, owner, isDryRunContext(ctx))
+		if err != nil {
+			ghostLog.Errorfln("Failed to deactivate ghosts of %s: %v", owner, err)
+			return
+		}
+		ghostLog.With(LogFields{"owner": owner}).Infofln("Deactivated %d ghosts of %s (dry run: %t), skipped %d still in rooms, %d failed",
+			len(report.Deactivated), owner, report.DryRun, len(report.InRooms), len(report.Failed))
+		SendWebhook(ctx, WebhookGhostsDeactivated, WebhookPayload{Owner: owner, Ghosts: report})
+	})
+	if started {
+		ghostJobs[owner] = struct{}{}
+	}
+	return started
+}
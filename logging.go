@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+)
+
+// contextKey is the type of the keys used to store values in contexts.
+type contextKey int
+
+const (
+	// logContextKey is the context key for the *Logger of the current request or queue item.
+	logContextKey contextKey = iota
+	// requestInfoContextKey is the context key for the *requestInfo of the current API request.
+	requestInfoContextKey
+	// dryRunContextKey is the context key for whether the current request or queue item is in dry run mode.
+	dryRunContextKey
+)
+
+// LogFields are the structured fields attached to log lines. They're only visible when LOG_FORMAT is json.
+type LogFields map[string]interface{}
+
+// Logger is a maulogger sublogger that remembers its module and fields,
+// so that loggers derived from it with Sub or With keep them.
+type Logger struct {
+	log.Logger
+	base   *log.BasicLogger
+	module string
+	fields LogFields
+}
+
+// Sub returns a logger with the given module appended to the module of this logger.
+func (l *Logger) Sub(module string) *Logger {
+	return l.derive(fmt.Sprintf("%s/%s", l.module, module), nil)
+}
+
+// With returns a logger with the given fields added to the fields of this logger.
+func (l *Logger) With(fields LogFields) *Logger {
+	return l.derive(l.module, fields)
+}
+
+func (l *Logger) derive(module string, fields LogFields) *Logger {
+	merged := make(LogFields, len(l.fields)+len(fields))
+	for key, val := range l.fields {
+		merged[key] = val
+	}
+	for key, val := range fields {
+		merged[key] = val
+	}
+	return &Logger{
+		Logger: l.base.Subm(module, merged),
+		base:   l.base,
+		module: module,
+		fields: merged,
+	}
+}
+
+// Log subsystems that can have their own log level with LOG_LEVELS.
+const (
+	SubsystemMain  = "main"
+	SubsystemAPI   = "api"
+	SubsystemQueue = "queue"
+	SubsystemAudit = "audit"
+)
+
+// subsystemLoggers contains the root logger of each subsystem. The main subsystem uses the default logger.
+var subsystemLoggers = map[string]*log.BasicLogger{
+	SubsystemMain: log.DefaultLogger,
+}
+
+// newSubsystemLogger creates a logger with the given module for a log subsystem.
+//
+// Each subsystem has a separate root logger so that their log levels can be changed separately.
+func newSubsystemLogger(subsystem, module string) *Logger {
+	base, ok := subsystemLoggers[subsystem]
+	if !ok {
+		base = log.Create().(*log.BasicLogger)
+		subsystemLoggers[subsystem] = base
+	}
+	return &Logger{
+		Logger: base.Subm(module, LogFields{"subsystem": subsystem}),
+		base:   base,
+		module: module,
+		fields: LogFields{"subsystem": subsystem},
+	}
+}
+
+var apiLog = newSubsystemLogger(SubsystemAPI, "Req")
+
+// logFromContext returns the logger stored in the given context, or the queue logger if there isn't one.
+func logFromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(logContextKey).(*Logger); ok {
+		return logger
+	}
+	return queueLog
+}
+
+// contextWithLog returns a copy of the given context with the given logger.
+func contextWithLog(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, logContextKey, logger)
+}
+
+// parseLogLevel parses a log level name.
+func parseLogLevel(name string) (log.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return log.LevelDebug, nil
+	case "info":
+		return log.LevelInfo, nil
+	case "warn", "warning":
+		return log.LevelWarn, nil
+	case "error":
+		return log.LevelError, nil
+	default:
+		return log.Level{}, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// parseLogLevels parses the LOG_LEVELS setting, which is either a comma-separated
+// list of subsystem=level pairs or a JSON object (i.e. a map in the config file).
+func parseLogLevels(val string) (map[string]log.Level, error) {
+	rawLevels := make(map[string]string)
+	if strings.HasPrefix(strings.TrimSpace(val), "{") {
+		if err := json.Unmarshal([]byte(val), &rawLevels); err != nil {
+			return nil, err
+		}
+	} else if len(val) > 0 {
+		for _, pair := range strings.Split(val, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("%q is not in the subsystem=level format", pair)
+			}
+			rawLevels[strings.TrimSpace(parts[0])] = parts[1]
+		}
+	}
+	levels := make(map[string]log.Level, len(rawLevels))
+	for subsystem, levelName := range rawLevels {
+		switch subsystem {
+		case SubsystemMain, SubsystemAPI, SubsystemQueue, SubsystemAudit:
+		default:
+			return nil, fmt.Errorf("unknown log subsystem %q", subsystem)
+		}
+		level, err := parseLogLevel(levelName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid level for %s: %w", subsystem, err)
+		}
+		levels[subsystem] = level
+	}
+	return levels, nil
+}
+
+// configureLogging applies the log format and levels from the config to all subsystem loggers.
+func configureLogging() {
+	for subsystem, logger := range subsystemLoggers {
+		level, ok := cfg.LogLevels[subsystem]
+		if !ok {
+			level = cfg.LogLevel
+		}
+		logger.PrintLevel = level.Severity
+		logger.TimeFormat = "Jan _2, 2006 15:04:05"
+		if cfg.LogFormat == "json" {
+			logger.EnableJSONStdout()
+		}
+	}
+}
+
+// roomLogger returns a logger with the correlation fields for the given room, bridge bot and stage.
+func roomLogger(logger *Logger, roomID id.RoomID, owner id.UserID, stage Stage) *Logger {
+	fields := LogFields{"room_id": roomID, "stage": stage}
+	if len(owner) > 0 {
+		fields["owner"] = owner
+	}
+	return logger.With(fields)
+}
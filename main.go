@@ -22,6 +22,28 @@ var adminClient *mautrix.Client
 var asmuxClient *mautrix.Client
 var asmuxDbPool *pgxpool.Pool
 
+// backgroundContext and backgroundWG are the loop context and the shutdown WaitGroup,
+// which background tasks started outside the loops are tied to by goBackground.
+var backgroundContext = context.Background()
+var backgroundWG = &sync.WaitGroup{}
+
+// goBackground runs the given function in a goroutine with a context that is cancelled on shutdown,
+// and makes shutdown wait for it. The logger, dry run mode and trace span of the given context are kept.
+//
+// It returns false if the function wasn't started because yeetserv is shutting down.
+func goBackground(ctx context.Context, fn func(ctx context.Context)) bool {
+	if backgroundContext.Err() != nil {
+		return false
+	}
+	ctx = detachContextTo(backgroundContext, ctx)
+	backgroundWG.Add(1)
+	go func() {
+		defer backgroundWG.Done()
+		fn(ctx)
+	}()
+	return true
+}
+
 func makeAdminClient() {
 	var err error
 	adminClient, err = mautrix.NewClient(cfg.SynapseURL, "", cfg.AdminAccessToken)
@@ -50,6 +72,7 @@ func makeAdminClient() {
 	}
 	// We use contexts for admin request timeout
 	adminClient.Client.Timeout = 0
+	instrumentClient(adminClient)
 }
 
 func makeAsmuxClient() {
@@ -59,6 +82,7 @@ func makeAsmuxClient() {
 		log.Fatalln("Failed to create asmux client:", err)
 		os.Exit(3)
 	}
+	instrumentClient(asmuxClient)
 }
 
 func makeAsmuxDbPool() bool {
@@ -66,7 +90,7 @@ func makeAsmuxDbPool() bool {
 		var err error
 		asmuxDbPool, err = pgxpool.Connect(context.Background(), cfg.AsmuxDatabaseURL)
 		if err != nil {
-			log.Fatalln("Unable to connect to asmux database: %v", err)
+			log.Fatalln("Unable to connect to asmux database:", err)
 			os.Exit(3)
 		}
 		return true
@@ -75,10 +99,26 @@ func makeAsmuxDbPool() bool {
 }
 
 func main() {
-	readEnv()
+	if len(os.Args) > 1 && os.Args[1] == "encrypt" {
+		runEncryptCommand()
+		return
+	}
+	readConfig()
+	if err := initTracing(); err != nil {
+		log.Fatalln("Failed to initialize tracing:", err)
+		os.Exit(3)
+	}
 	makeAdminClient()
 	makeAsmuxClient()
 	initQueue()
+	initMediaQueue()
+	if len(cfg.AdminAPIKeys) == 0 {
+		if len(cfg.AdminAccessToken) > 0 {
+			log.Warnln("ADMIN_API_KEYS is not set, accepting ADMIN_ACCESS_TOKEN with all scopes for the admin API")
+		} else {
+			log.Warnln("ADMIN_API_KEYS is not set, the admin API is disabled")
+		}
+	}
 
 	didMakePool := makeAsmuxDbPool()
 	if didMakePool {
@@ -88,15 +128,25 @@ func main() {
 	var wg sync.WaitGroup
 	wg.Add(3)
 	loopContext, stopLoop := context.WithCancel(context.Background())
+	backgroundContext, backgroundWG = loopContext, &wg
 
 	router := mux.NewRouter()
 	router.HandleFunc("/_matrix/client/unstable/com.beeper.yeetserv/clean_all", handleCleanAllRooms).Methods(http.MethodPost)
 	router.HandleFunc("/_matrix/client/unstable/com.beeper.yeetserv/queue", handleQueue).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/com.beeper.yeetserv/cancel", handleCancelCleanup).Methods(http.MethodPost)
 	router.HandleFunc("/_matrix/client/unstable/com.beeper.yeetserv/admin_clean_rooms", handleAdminCleanRooms).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/com.beeper.yeetserv/admin_clean_user", handleAdminCleanUser).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/com.beeper.yeetserv/admin_restore_rooms", handleAdminRestoreRooms).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/com.beeper.yeetserv/admin_audit", handleAdminAudit).Methods(http.MethodGet)
+	router.HandleFunc("/_matrix/client/unstable/com.beeper.yeetserv/admin_pause", handleAdminPause).Methods(http.MethodPost)
+	router.HandleFunc("/_matrix/client/unstable/com.beeper.yeetserv/admin_deactivate_ghosts", handleAdminDeactivateGhosts).Methods(http.MethodPost)
+	router.HandleFunc("/health", handleHealth).Methods(http.MethodGet)
+	router.HandleFunc("/ready", handleReady).Methods(http.MethodGet)
+	router.HandleFunc("/status", handleStatus).Methods(http.MethodGet)
 	router.Handle("/metrics", promhttp.Handler())
 	server := &http.Server{
 		Addr:    cfg.ListenAddress,
-		Handler: router,
+		Handler: instrumentHandler(router),
 	}
 	go func() {
 		log.Infoln("Starting to listen on", cfg.ListenAddress)
@@ -111,16 +161,31 @@ func main() {
 	go loopLeaveQueue(loopContext, &wg)
 	go loopDeleteQueue(loopContext, &wg)
 	go loopQueueStats(loopContext, &wg)
+	wg.Add(1)
+	go loopAdminLoginJanitor(loopContext, &wg)
+	if cfg.MediaCleanup {
+		wg.Add(1)
+		go loopMediaQueue(loopContext, &wg)
+	}
 
-	if cfg.DryRun {
+	if isDryRun() {
 		log.Infoln("Running in dry run mode")
 	} else {
 		log.Infoln("Running in destructive mode")
 	}
 
-	log.Infofln("Rooms will wait in the delete queue for %v", cfg.PostponeDeletion)
+	log.Infofln("Rooms will wait in the delete queue for %v", getPostponeDeletion())
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Infoln("Received SIGHUP, reloading config")
+			reloadConfig()
+		}
+	}()
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 
@@ -145,5 +210,11 @@ func main() {
 	}
 	log.Infoln("Waiting for loop and server to exit")
 	wg.Wait()
+	logoutCtx, cancelLogout := context.WithTimeout(context.Background(), 10*time.Second)
+	LogoutAllAdminLogins(logoutCtx)
+	cancelLogout()
+	if err = shutdownTracing(ctx); err != nil {
+		log.Errorln("Failed to flush traces:", err)
+	}
 	log.Infoln("Everything shut down")
 }
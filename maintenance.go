@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	// Embed the time zone database, as the docker image doesn't have one
+	_ "time/tzdata"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maintenanceCheckInterval is how often the loops check if a maintenance window has opened while waiting.
+const maintenanceCheckInterval = 30 * time.Second
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// MaintenanceWindow is a time range on certain days of the week when a loop is allowed to process rooms.
+//
+// If End is before Start, the window continues past midnight into the next day.
+type MaintenanceWindow struct {
+	Days  [7]bool
+	Start int
+	End   int
+}
+
+// MaintenanceSchedule is the list of windows when a loop is allowed to process rooms, in the given time zone.
+//
+// A nil schedule is always open.
+type MaintenanceSchedule struct {
+	Windows  []MaintenanceWindow
+	Location *time.Location
+}
+
+func parseWeekday(name string) (time.Weekday, error) {
+	day, ok := weekdayNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown day %q", name)
+	}
+	return day, nil
+}
+
+// parseMinuteOfDay parses a HH:MM time into the number of minutes since midnight. 24:00 is allowed as the end of the day.
+func parseMinuteOfDay(val string) (int, error) {
+	parts := strings.Split(val, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time %q", val)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", val)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q", val)
+	}
+	return hour*60 + minute, nil
+}
+
+// parseMaintenanceWindow parses a window in the format "<days> <HH:MM>-<HH:MM>",
+// where days is *, a single day (e.g. sat) or a range of days (e.g. mon-fri).
+// If the days are omitted, the window applies to every day.
+func parseMaintenanceWindow(val string) (window MaintenanceWindow, err error) {
+	fields := strings.Fields(val)
+	var days, times string
+	switch len(fields) {
+	case 1:
+		days, times = "*", fields[0]
+	case 2:
+		days, times = fields[0], fields[1]
+	default:
+		return window, fmt.Errorf("invalid window %q", val)
+	}
+
+	if days == "*" {
+		window.Days = [7]bool{true, true, true, true, true, true, true}
+	} else {
+		dayRange := strings.SplitN(days, "-", 2)
+		var first, last time.Weekday
+		if first, err = parseWeekday(dayRange[0]); err != nil {
+			return
+		}
+		last = first
+		if len(dayRange) == 2 {
+			if last, err = parseWeekday(dayRange[1]); err != nil {
+				return
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			window.Days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	timeRange := strings.SplitN(times, "-", 2)
+	if len(timeRange) != 2 {
+		return window, fmt.Errorf("invalid time range %q", times)
+	}
+	if window.Start, err = parseMinuteOfDay(timeRange[0]); err != nil {
+		return
+	} else if window.End, err = parseMinuteOfDay(timeRange[1]); err != nil {
+		return
+	} else if window.Start == window.End {
+		return window, fmt.Errorf("window %q is empty", val)
+	} else if window.Start == 24*60 {
+		return window, fmt.Errorf("window %q can't start at 24:00", val)
+	}
+	return
+}
+
+// parseMaintenanceSchedule parses the given windows and time zone. If there are no windows, nil is returned.
+func parseMaintenanceSchedule(windows []string, timezone string) (*MaintenanceSchedule, error) {
+	if len(windows) == 0 {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone: %w", err)
+	}
+	sched := &MaintenanceSchedule{Location: location, Windows: make([]MaintenanceWindow, len(windows))}
+	for i, val := range windows {
+		if sched.Windows[i], err = parseMaintenanceWindow(val); err != nil {
+			return nil, err
+		}
+	}
+	return sched, nil
+}
+
+// IsOpen returns true if the given time is inside one of the windows.
+func (sched *MaintenanceSchedule) IsOpen(now time.Time) bool {
+	if sched == nil {
+		return true
+	}
+	now = now.In(sched.Location)
+	day := now.Weekday()
+	previousDay := (day + 6) % 7
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range sched.Windows {
+		if window.Start < window.End {
+			if window.Days[day] && minute >= window.Start && minute < window.End {
+				return true
+			}
+		} else if (window.Days[day] && minute >= window.Start) || (window.Days[previousDay] && minute < window.End) {
+			return true
+		}
+	}
+	return false
+}
+
+func getLeaveWindows() *MaintenanceSchedule {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.LeaveWindows
+}
+
+func getDeleteWindows() *MaintenanceSchedule {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return cfg.DeleteWindows
+}
+
+var promLeaveWindowOpenGauge = promauto.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name:        "yeetserv_maintenance_window_open",
+		Help:        "Whether the current time is inside a maintenance window of the loop",
+		ConstLabels: prometheus.Labels{"loop": "leave"},
+	},
+	func() float64 { return boolGauge(getLeaveWindows().IsOpen(time.Now())) },
+)
+var promDeleteWindowOpenGauge = promauto.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name:        "yeetserv_maintenance_window_open",
+		Help:        "Whether the current time is inside a maintenance window of the loop",
+		ConstLabels: prometheus.Labels{"loop": "delete"},
+	},
+	func() float64 { return boolGauge(getDeleteWindows().IsOpen(time.Now())) },
+)
+
+func boolGauge(val bool) float64 {
+	if val {
+		return 1
+	}
+	return 0
+}
+
+// waitForMaintenanceWindow blocks until the current time is inside one of the windows returned by getSchedule,
+// or the context is cancelled.
+//
+// The schedule is re-read on every check so that changes from reloading the config apply to waiting loops.
+func waitForMaintenanceWindow(ctx context.Context, loop string, getSchedule func() *MaintenanceSchedule) {
+	logged := false
+	for !getSchedule().IsOpen(time.Now()) {
+		if !logged {
+			queueLog.Debugfln("Waiting, %s loop is outside its maintenance windows", loop)
+			logged = true
+		}
+		select {
+		case <-time.After(maintenanceCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+	if logged {
+		queueLog.Debugfln("Maintenance window of %s loop opened, resuming", loop)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"maunium.net/go/mautrix/id"
+)
+
+// mediaQueueKey is the redis list of users whose media is waiting to be deleted.
+const mediaQueueKey = "yeetserv:media_queue"
+
+// MediaCleanupItem is a bridge bot or ghost user whose uploaded media is waiting to be deleted.
+type MediaCleanupItem struct {
+	UserID    id.UserID `json:"user_id"`
+	Owner     id.UserID `json:"owner"`
+	QueueTime time.Time `json:"queue_time"`
+	// DryRun is whether the user was queued in dry run mode. It's not stored in redis, as dry run mode uses separate queues.
+	DryRun bool `json:"-"`
+}
+
+var mediaLog = newSubsystemLogger(SubsystemQueue, "Media")
+var mediaQueue chan *MediaCleanupItem
+
+var promMediaQueueGauge = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "yeetserv_media_queue_length",
+		Help: "Current length of yeetserv's media queue",
+	},
+)
+var promMediaUserCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "yeetserv_media_users_total",
+		Help: "Number of bridge users whose media was cleaned up",
+	},
+	[]string{"bridge", "outcome"},
+)
+var promMediaDeletedCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "yeetserv_media_deleted_total",
+		Help: "Number of media files deleted",
+	},
+	[]string{"bridge"},
+)
+var promMediaDeletedBytesCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "yeetserv_media_deleted_bytes_total",
+		Help: "Total size of media files deleted in bytes",
+	},
+	[]string{"bridge"},
+)
+
+func initMediaQueue() {
+	if rds != nil {
+		mediaLog.Debugln("Redis media queue key:", queueKeyFor(mediaQueueKey, isDryRun()))
+	} else {
+		mediaQueue = make(chan *MediaCleanupItem, 8192)
+	}
+}
+
+func PushMediaQueue(ctx context.Context, item *MediaCleanupItem) error {
+	item.QueueTime = time.Now()
+	item.DryRun = isDryRunContext(ctx)
+	if rds != nil {
+		data, err := encodeQueueItem(item)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s to redis: %w", item.UserID, err)
+		}
+		err = rds.RPush(ctx, queueKey(ctx, mediaQueueKey), data).Err()
+		if err != nil {
+			return fmt.Errorf("failed to push %s to redis: %w", item.UserID, err)
+		}
+		return nil
+	}
+	select {
+	case mediaQueue <- item:
+		promMediaQueueGauge.Set(float64(len(mediaQueue)))
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func popMediaQueue(ctx context.Context) (*MediaCleanupItem, bool) {
+	if rds != nil {
+		nextItem, err := rds.BLPop(ctx, 0, queueKey(ctx, mediaQueueKey)).Result()
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				mediaLog.Errorln("Failed to get next media item from redis:", err)
+			}
+			return nil, false
+		}
+		promMediaQueueGauge.Set(float64(rds.LLen(ctx, queueKey(ctx, mediaQueueKey)).Val()))
+		item := &MediaCleanupItem{}
+		if err = decodeQueueItem(nextItem[1], item); err != nil {
+			mediaLog.Errorln("Failed to unmarshal next media item from redis:", err)
+			if isEncrypted(nextItem[1]) {
+				if err = rds.RPush(ctx, queueKey(ctx, mediaQueueKey), nextItem[1]).Err(); err != nil {
+					mediaLog.Errorln("Failed to put encrypted media item back to redis:", err)
+				}
+			}
+			return nil, false
+		}
+		item.DryRun = isDryRunContext(ctx)
+		return item, true
+	}
+	select {
+	case item := <-mediaQueue:
+		promMediaQueueGauge.Set(float64(len(mediaQueue)))
+		return item, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// queueMediaCleanupAfterDrain queues the bridge bot and all ghosts of the given bridge for media cleanup
+// if MEDIA_CLEANUP is enabled and the whole bridge was cleaned up.
+//
+// Drains of rooms queued individually with the queue endpoint never delete media, as the bridge may still be running.
+// The users are queued in the background, which is stopped on shutdown.
+func queueMediaCleanupAfterDrain(ctx context.Context, owner id.UserID, summary *OwnerSummary) {
+	if !cfg.MediaCleanup || !summary.isTeardown() {
+		return
+	}
+	started := goBackground(ctx, func(ctx context.Context) {
+		// Deactivated ghosts are included, as deactivating a user doesn't remove its media.
+		ghosts, err := listBridgeGhosts(ctx, owner, true)
+		if err != nil {
+			mediaLog.Errorfln("Failed to list ghosts of %s for media cleanup: %v", owner, err)
+			return
+		}
+		users := append([]id.UserID{owner}, ghosts...)
+		queued := 0
+		for _, userID := range users {
+			if ctx.Err() != nil {
+				mediaLog.Warnfln("Stopped queuing media cleanup of %s after %d users as yeetserv is shutting down", owner, queued)
+				return
+			}
+			// Users that are still in rooms may have sent media that is still visible there
+			rooms, err := adminListUserRooms(ctx, userID)
+			if err != nil {
+				mediaLog.Warnfln("Not cleaning up media of %s as listing its rooms failed: %v", userID, err)
+				continue
+			} else if len(rooms) > 0 {
+				mediaLog.Debugfln("Not cleaning up media of %s as it's still in %d rooms", userID, len(rooms))
+				continue
+			}
+			if err = PushMediaQueue(ctx, &MediaCleanupItem{UserID: userID, Owner: owner}); err != nil {
+				mediaLog.Errorfln("Failed to queue media cleanup of %s: %v", userID, err)
+				return
+			}
+			queued++
+		}
+		mediaLog.With(LogFields{"owner": owner}).Infofln("Queued media cleanup of %d out of %d users of %s", queued, len(users), owner)
+	})
+	if !started {
+		mediaLog.Warnfln("Not queuing media cleanup of %s as yeetserv is shutting down", owner)
+	}
+}
+
+func loopMediaQueue(ctx context.Context, wg *sync.WaitGroup) {
+	setLoopRunning("media", true)
+	defer func() {
+		setLoopRunning("media", false)
+		mediaLog.Infoln("Queue media loop exiting")
+		wg.Done()
+	}()
+	for {
+		success := consumeMediaQueue(ctx)
+		var wait time.Duration
+		if !success {
+			wait = time.Second * 1
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func consumeMediaQueue(ctx context.Context) bool {
+	waitForMaintenanceWindow(ctx, "media", getDeleteWindows)
+	item, ok := popMediaQueue(ctx)
+	if !ok {
+		return false
+	}
+	ctx = contextWithDryRun(ctx, item.DryRun)
+	userLog := mediaLog.With(LogFields{"owner": item.Owner})
+	bridge := bridgeLabel(item.Owner)
+	deleted, size, err := cleanUserMedia(ctx, item.UserID, bridge)
+	if errors.Is(err, context.Canceled) {
+		userLog.Debugfln("Context was canceled while cleaning up media of %s, putting it back in the queue", item.UserID)
+		if err = PushMediaQueue(detachContext(ctx), item); err != nil {
+			userLog.Errorfln("Failed to put %s back in the media queue: %v", item.UserID, err)
+		}
+		return false
+	} else if err != nil {
+		userLog.Warnfln("Failed to clean up media of %s after deleting %d files: %v", item.UserID, deleted, err)
+		promMediaUserCounter.WithLabelValues(bridge, string(OutcomeError)).Inc()
+	} else if item.DryRun {
+		userLog.Debugfln("Would have deleted %d media files (%d bytes) of %s (dry run)", deleted, size, item.UserID)
+		promMediaUserCounter.WithLabelValues(bridge, string(OutcomeSuccess)).Inc()
+	} else {
+		userLog.Debugfln("Deleted %d media files (%d bytes) of %s", deleted, size, item.UserID)
+		promMediaUserCounter.WithLabelValues(bridge, string(OutcomeSuccess)).Inc()
+	}
+	return true
+}
+
+// cleanUserMedia deletes the media uploaded by the given user that is older than MEDIA_MIN_AGE, oldest first,
+// in batches of MEDIA_BATCH_SIZE. It returns the number and total size of the deleted media.
+//
+// In dry run mode, the media is only counted.
+func cleanUserMedia(ctx context.Context, userID id.UserID, bridge string) (deleted int, size int64, err error) {
+	cutoff := time.Now().Add(-cfg.MediaMinAge).UnixMilli()
+	dryRun := isDryRunContext(ctx)
+	from := 0
+	for {
+		var resp *RespListUserMedia
+		resp, err = adminListUserMedia(ctx, userID, from, cfg.MediaBatchSize)
+		if err != nil {
+			return
+		}
+		// The media is sorted by creation time, so the old enough media is always at the start of the batch.
+		oldCount := 0
+		var oldSize int64
+		for _, media := range resp.Media {
+			if media.CreatedTS >= cutoff {
+				break
+			}
+			oldCount++
+			oldSize += media.MediaLength
+		}
+		if oldCount == 0 {
+			return
+		}
+		if dryRun {
+			// Nothing is deleted, so page through the media instead
+			from += len(resp.Media)
+		} else {
+			var deleteResp *RespDeleteUserMedia
+			deleteResp, err = adminDeleteUserMedia(ctx, userID, oldCount)
+			if err != nil {
+				return
+			}
+			if deleteResp.Total == 0 {
+				err = fmt.Errorf("no media was deleted out of %d files", oldCount)
+				return
+			} else if deleteResp.Total != oldCount {
+				mediaLog.Warnfln("Expected to delete %d media files of %s, but %d were deleted", oldCount, userID, deleteResp.Total)
+			}
+			oldCount = deleteResp.Total
+			promMediaDeletedCounter.WithLabelValues(bridge).Add(float64(oldCount))
+			promMediaDeletedBytesCounter.WithLabelValues(bridge).Add(float64(oldSize))
+		}
+		deleted += oldCount
+		size += oldSize
+		if oldCount < len(resp.Media) || resp.NextToken == nil {
+			return
+		}
+		select {
+		case <-time.After(cfg.MediaCleanupInterval):
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+}
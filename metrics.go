@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"maunium.net/go/mautrix/id"
+)
+
+// Stage is a step in the room cleanup process, used as the stage label in metrics.
+type Stage string
+
+const (
+	StageFilter      Stage = "filter"
+	StageLeave       Stage = "leave"
+	StageAlias       Stage = "alias"
+	StageAsmuxForget Stage = "asmux_forget"
+	StageDelete      Stage = "delete"
+)
+
+// Outcome is the result of a cleanup stage, used as the outcome label in metrics.
+type Outcome string
+
+const (
+	OutcomeSuccess   Outcome = "success"
+	OutcomeRejected  Outcome = "rejected"
+	OutcomeError     Outcome = "error"
+	OutcomeCancelled Outcome = "cancelled"
+)
+
+var promStageCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "yeetserv_stage_total",
+		Help: "Number of rooms processed by each cleanup stage",
+	},
+	[]string{"bridge", "stage", "outcome"},
+)
+var promRuleRejectionCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "yeetserv_rule_rejections_total",
+		Help: "Number of rooms or requests rejected by the cleanup rules",
+	},
+	[]string{"bridge", "reason"},
+)
+
+// bridgeLabel returns the bridge type of the given bridge bot for use as a metric label.
+func bridgeLabel(owner id.UserID) string {
+	if len(owner) == 0 {
+		return "unknown"
+	}
+	_, bridgeName, _, err := parseBridgeName(owner)
+	if err != nil {
+		return "unknown"
+	}
+	return bridgeName
+}
+
+// observeStage increments the stage counter for the given bridge bot, stage and outcome.
+func observeStage(owner id.UserID, stage Stage, outcome Outcome) {
+	promStageCounter.WithLabelValues(bridgeLabel(owner), string(stage), string(outcome)).Inc()
+}
+
+// observeStageError is a wrapper for observeStage that picks the outcome based on the error.
+func observeStageError(owner id.UserID, stage Stage, err error) {
+	var rejection *RuleRejection
+	if err == nil {
+		observeStage(owner, stage, OutcomeSuccess)
+	} else if errors.As(err, &rejection) {
+		observeStage(owner, stage, OutcomeRejected)
+		promRuleRejectionCounter.WithLabelValues(bridgeLabel(owner), rejection.Reason).Inc()
+	} else if errors.Is(err, context.Canceled) {
+		observeStage(owner, stage, OutcomeCancelled)
+	} else {
+		observeStage(owner, stage, OutcomeError)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ownerNotifyKey is the redis hash containing the pending completion notification options of each bridge bot.
+const ownerNotifyKey = "yeetserv:owner_notify"
+
+// EventCleanupComplete is the to-device event type sent to a bridge bot when all its queued rooms have been processed.
+var EventCleanupComplete = event.Type{Type: "com.beeper.yeetserv.cleanup_complete", Class: event.ToDeviceEventType}
+
+// NotifyOptions are the request fields for choosing how a bridge is notified when all of its queued rooms have been processed.
+type NotifyOptions struct {
+	// NotifyRoomID is a management room where a notice with the summary is sent.
+	NotifyRoomID id.RoomID `json:"notify_room_id,omitempty"`
+	// NotifyToDevice makes yeetserv send a to-device event with the summary to all devices of the bridge bot.
+	NotifyToDevice bool `json:"notify_to_device,omitempty"`
+}
+
+// IsSet returns true if the bridge wants to be notified.
+func (opts *NotifyOptions) IsSet() bool {
+	return len(opts.NotifyRoomID) > 0 || opts.NotifyToDevice
+}
+
+// CleanupCompleteContent is the content of the to-device event, and the extra field in the management room notice.
+type CleanupCompleteContent struct {
+	Summary *OwnerSummary `json:"summary"`
+}
+
+// CleanupCompleteNotice is the content of the notice sent to the management room.
+type CleanupCompleteNotice struct {
+	event.MessageEventContent
+	Cleanup *CleanupCompleteContent `json:"com.beeper.yeetserv.cleanup_complete"`
+}
+
+// notifyClientsLock is the mutex used to lock reading/writing the notifyClients and notifyOptions maps.
+var notifyClientsLock sync.Mutex
+
+// notifyClients contains the as_token clients of the bridges that asked to be notified.
+var notifyClients = make(map[id.UserID]*mautrix.Client)
+
+// notifyOptions contains the notification options of each bridge bot when not using redis.
+var notifyOptions = make(map[id.UserID]*NotifyOptions)
+
+// RegisterOwnerNotification stores the notification options of the bridge bot that the given client belongs to.
+//
+// The client is only kept in memory. If yeetserv is restarted before the rooms are processed,
+// the notification is sent by masquerading as the bridge bot with ASMUX_AS_TOKEN instead.
+func RegisterOwnerNotification(ctx context.Context, client *mautrix.Client, opts *NotifyOptions) error {
+	if !opts.IsSet() {
+		return nil
+	}
+	notifyClientsLock.Lock()
+	notifyClients[client.UserID] = client
+	if rds == nil {
+		notifyOptions[client.UserID] = opts
+	}
+	notifyClientsLock.Unlock()
+	if rds != nil {
+		optsJSON, err := json.Marshal(opts)
+		if err != nil {
+			return err
+		}
+		return rds.HSet(ctx, queueKey(ctx, ownerNotifyKey), ownerRedisID(client.UserID), optsJSON).Err()
+	}
+	return nil
+}
+
+// takeOwnerNotification returns and removes the notification options and client of the given bridge bot.
+func takeOwnerNotification(ctx context.Context, owner id.UserID) (*NotifyOptions, *mautrix.Client, error) {
+	notifyClientsLock.Lock()
+	client := notifyClients[owner]
+	delete(notifyClients, owner)
+	opts := notifyOptions[owner]
+	delete(notifyOptions, owner)
+	notifyClientsLock.Unlock()
+	if rds != nil {
+		optsJSON, err := rds.HGet(ctx, queueKey(ctx, ownerNotifyKey), ownerRedisID(owner)).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil, nil, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		rds.HDel(ctx, queueKey(ctx, ownerNotifyKey), ownerRedisID(owner))
+		opts = &NotifyOptions{}
+		if err = json.Unmarshal([]byte(optsJSON), opts); err != nil {
+			return nil, nil, err
+		}
+	}
+	return opts, client, nil
+}
+
+// formatSummary returns a human-readable version of the given summary for the management room notice.
+func formatSummary(summary *OwnerSummary) string {
+	var text strings.Builder
+	_, _ = fmt.Fprintf(&text, "Room cleanup complete: %d deleted, %d failed, %d restored", summary.Deleted, summary.Failed, summary.Restored)
+	for _, failure := range summary.Failures {
+		_, _ = fmt.Fprintf(&text, "\n* %s: %s", failure.RoomID, failure.Error)
+	}
+	return text.String()
+}
+
+// NotifyOwner sends the completion notification to the given bridge bot if it asked for one.
+func NotifyOwner(ctx context.Context, owner id.UserID, summary *OwnerSummary) {
+	notifyLog := queueLog.With(LogFields{"owner": owner})
+	opts, client, err := takeOwnerNotification(ctx, owner)
+	if err != nil {
+		notifyLog.Warnfln("Failed to get notification options of %s: %v", owner, err)
+		return
+	} else if opts == nil || !opts.IsSet() {
+		return
+	} else if isDryRunContext(ctx) {
+		notifyLog.Debugfln("Not notifying %s about completed cleanup as we're in dry run mode", owner)
+		return
+	} else if client == nil {
+		if len(cfg.AsmuxASToken) == 0 {
+			notifyLog.Warnfln("Can't notify %s about completed cleanup: the client from the request is gone and ASMUX_AS_TOKEN is not set", owner)
+			return
+		}
+		client = masqueradeClient(asmuxClient, owner)
+	}
+
+	content := &CleanupCompleteContent{Summary: summary}
+	if len(opts.NotifyRoomID) > 0 {
+		_, err = client.SendMessageEvent(opts.NotifyRoomID, event.EventMessage, &CleanupCompleteNotice{
+			MessageEventContent: event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    formatSummary(summary),
+			},
+			Cleanup: content,
+		})
+		if err != nil {
+			notifyLog.Warnfln("Failed to send cleanup summary to %s for %s: %v", opts.NotifyRoomID, owner, err)
+		} else {
+			notifyLog.Debugfln("Sent cleanup summary to %s for %s", opts.NotifyRoomID, owner)
+		}
+	}
+	if opts.NotifyToDevice {
+		_, err = client.SendToDevice(EventCleanupComplete, &mautrix.ReqSendToDevice{
+			Messages: map[id.UserID]map[id.DeviceID]*event.Content{
+				owner: {"*": {Parsed: content}},
+			},
+		})
+		if err != nil {
+			notifyLog.Warnfln("Failed to send cleanup summary to-device event to %s: %v", owner, err)
+		} else {
+			notifyLog.Debugfln("Sent cleanup summary to-device event to %s", owner)
+		}
+	}
+}
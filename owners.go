@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"maunium.net/go/mautrix/id"
+)
+
+// ownerPendingKey is the redis hash containing the number of rooms of each bridge bot in the leave and delete queues.
+//
+// The bridge bots in its fields and in the names of the per-owner keys below are identified by ownerRedisID.
+const ownerPendingKey = "yeetserv:owner_pending"
+
+// ownerSummaryKeyPrefix is the prefix of the redis hashes containing the number of rooms of a bridge bot by outcome.
+const ownerSummaryKeyPrefix = "yeetserv:owner_summary:"
+
+// ownerFailuresKeyPrefix is the prefix of the redis lists containing the failed rooms of a bridge bot.
+const ownerFailuresKeyPrefix = "yeetserv:owner_failures:"
+
+// ownerDeletedKeyPrefix is the prefix of the redis lists containing the deleted rooms of a bridge bot.
+const ownerDeletedKeyPrefix = "yeetserv:owner_deleted:"
+
+// ownerFullCleanupField is the field in the owner summary hash that is set when all rooms of the bridge bot were queued.
+const ownerFullCleanupField = "full_cleanup"
+
+// maxOwnerFailures is the maximum number of failed rooms included in the summary.
+const maxOwnerFailures = 100
+
+// RoomFailure is a room that was pushed to the error queue.
+type RoomFailure struct {
+	RoomID id.RoomID `json:"room_id"`
+	Error  string    `json:"error"`
+}
+
+// OwnerSummary contains the number of rooms of a bridge bot by how they left the queues since the owner was last drained.
+type OwnerSummary struct {
+	Deleted  int64         `json:"deleted"`
+	Failed   int64         `json:"failed"`
+	Restored int64         `json:"restored"`
+	Failures []RoomFailure `json:"failures,omitempty"`
+	// FullCleanup is true if all rooms of the bridge were queued by a completed clean_all or admin_clean_user request,
+	// rather than only some rooms with the queue endpoints.
+	FullCleanup bool `json:"full_cleanup,omitempty"`
+}
+
+// isTeardown returns true if the summary is of a whole bridge being cleaned up rather than individual rooms,
+// and none of the rooms were restored. The bridge's ghosts and media are only cleaned up after a teardown.
+func (summary *OwnerSummary) isTeardown() bool {
+	return summary.FullCleanup && summary.Deleted > 0 && summary.Restored == 0
+}
+
+func (summary *OwnerSummary) add(outcome AuditEvent, failure *RoomFailure) {
+	switch outcome {
+	case AuditEventDeleted:
+		summary.Deleted++
+	case AuditEventFailed:
+		summary.Failed++
+		if failure != nil && len(summary.Failures) < maxOwnerFailures {
+			summary.Failures = append(summary.Failures, *failure)
+		}
+	case AuditEventRestored:
+		summary.Restored++
+	}
+}
+
+// untrackOwnerRoomScript decrements the pending room count of an owner and removes it when it reaches zero.
+var untrackOwnerRoomScript = redis.NewScript(`
+local count = redis.call('HINCRBY', KEYS[1], ARGV[1], -1)
+if count <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// ownerPendingLock is the mutex used to lock reading/writing the ownerPending map.
+var ownerPendingLock sync.Mutex
+
+// ownerPending contains the number of rooms of each bridge bot in the leave and delete queues when not using redis.
+var ownerPending = make(map[id.UserID]int64)
+
+// ownerSummaries contains the summary of each bridge bot when not using redis.
+var ownerSummaries = make(map[id.UserID]*OwnerSummary)
+
+// ownerDeleted contains the deleted rooms of each bridge bot when not using redis.
+var ownerDeleted = make(map[id.UserID][]id.RoomID)
+
+// TrackOwnerRoom records that a room of the given bridge bot was added to the leave or delete queue.
+//
+// It must only be called when a room enters the queues, not when it moves between them or is requeued.
+func TrackOwnerRoom(ctx context.Context, owner id.UserID) {
+	if len(owner) == 0 {
+		return
+	}
+	if rds != nil {
+		if err := rds.HIncrBy(ctx, queueKey(ctx, ownerPendingKey), ownerRedisID(owner), 1).Err(); err != nil {
+			queueLog.Warnfln("Failed to increment pending room count of %s: %v", owner, err)
+		}
+	} else {
+		ownerPendingLock.Lock()
+		ownerPending[owner]++
+		ownerPendingLock.Unlock()
+	}
+}
+
+// UntrackOwnerRoom records that a room of the given bridge bot left the queues,
+// either because it was deleted, failed or was restored.
+//
+// If it was the last room of the owner and there's no clean_all or cancel request active for the owner,
+// the owner drained notifications are sent.
+func UntrackOwnerRoom(ctx context.Context, owner id.UserID, roomID id.RoomID, outcome AuditEvent, roomErr error) {
+	if len(owner) == 0 {
+		return
+	}
+	var failure *RoomFailure
+	if roomErr != nil {
+		failure = &RoomFailure{RoomID: roomID, Error: roomErr.Error()}
+	}
+	var count int64
+	if rds != nil {
+		ownerID := ownerRedisID(owner)
+		err := rds.HIncrBy(ctx, queueKey(ctx, ownerSummaryKeyPrefix+ownerID), string(outcome), 1).Err()
+		if err != nil {
+			queueLog.Warnfln("Failed to update summary of %s: %v", owner, err)
+		}
+		if failure != nil {
+			failuresKey := queueKey(ctx, ownerFailuresKeyPrefix+ownerID)
+			if failureData, err := encodeQueueItem(failure); err != nil {
+				queueLog.Warnfln("Failed to marshal failure of %s: %v", roomID, err)
+			} else if err = rds.RPush(ctx, failuresKey, failureData).Err(); err != nil {
+				queueLog.Warnfln("Failed to add %s to failures of %s: %v", roomID, owner, err)
+			} else {
+				rds.LTrim(ctx, failuresKey, 0, maxOwnerFailures-1)
+			}
+		} else if outcome == AuditEventDeleted {
+			if err = rds.RPush(ctx, queueKey(ctx, ownerDeletedKeyPrefix+ownerID), roomID.String()).Err(); err != nil {
+				queueLog.Warnfln("Failed to add %s to deleted rooms of %s: %v", roomID, owner, err)
+			}
+		}
+		count, err = untrackOwnerRoomScript.Run(ctx, rds, []string{queueKey(ctx, ownerPendingKey)}, ownerID).Int64()
+		if err != nil {
+			queueLog.Warnfln("Failed to decrement pending room count of %s: %v", owner, err)
+			return
+		}
+	} else {
+		ownerPendingLock.Lock()
+		summary, ok := ownerSummaries[owner]
+		if !ok {
+			summary = &OwnerSummary{}
+			ownerSummaries[owner] = summary
+		}
+		summary.add(outcome, failure)
+		if outcome == AuditEventDeleted {
+			ownerDeleted[owner] = append(ownerDeleted[owner], roomID)
+		}
+		ownerPending[owner]--
+		count = ownerPending[owner]
+		if count <= 0 {
+			delete(ownerPending, owner)
+		}
+		ownerPendingLock.Unlock()
+	}
+	// A negative count means the room was queued before pending rooms were tracked,
+	// so there may be more untracked rooms of the owner in the queues.
+	if count == 0 && !HasActiveJob(owner) {
+		onOwnerDrained(ctx, owner)
+	}
+}
+
+// MarkOwnerFullCleanup records in the summary of the given bridge bot that all of its rooms were queued,
+// which allows cleaning up its ghosts and media once the rooms have been deleted.
+func MarkOwnerFullCleanup(ctx context.Context, owner id.UserID) {
+	if rds != nil {
+		err := rds.HSet(ctx, queueKey(ctx, ownerSummaryKeyPrefix+ownerRedisID(owner)), ownerFullCleanupField, "1").Err()
+		if err != nil {
+			queueLog.Warnfln("Failed to mark %s as fully cleaned up: %v", owner, err)
+		}
+		return
+	}
+	ownerPendingLock.Lock()
+	summary, ok := ownerSummaries[owner]
+	if !ok {
+		summary = &OwnerSummary{}
+		ownerSummaries[owner] = summary
+	}
+	summary.FullCleanup = true
+	ownerPendingLock.Unlock()
+}
+
+// GetOwnerPending returns the number of rooms of the given bridge bot in the leave and delete queues.
+func GetOwnerPending(ctx context.Context, owner id.UserID) (int64, error) {
+	if rds != nil {
+		count, err := rds.HGet(ctx, queueKey(ctx, ownerPendingKey), ownerRedisID(owner)).Int64()
+		if errors.Is(err, redis.Nil) {
+			return 0, nil
+		}
+		return count, err
+	}
+	ownerPendingLock.Lock()
+	defer ownerPendingLock.Unlock()
+	return ownerPending[owner], nil
+}
+
+// GetOwnerDeletedRooms returns the rooms of the given bridge bot that were deleted since the owner was last drained.
+func GetOwnerDeletedRooms(ctx context.Context, owner id.UserID) ([]id.RoomID, error) {
+	if rds == nil {
+		ownerPendingLock.Lock()
+		defer ownerPendingLock.Unlock()
+		return append([]id.RoomID{}, ownerDeleted[owner]...), nil
+	}
+	items, err := rds.LRange(ctx, queueKey(ctx, ownerDeletedKeyPrefix+ownerRedisID(owner)), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	rooms := make([]id.RoomID, len(items))
+	for i, item := range items {
+		rooms[i] = id.RoomID(item)
+	}
+	return rooms, nil
+}
+
+// takeOwnerSummary returns the summary of the given bridge bot and resets it, including the list of deleted rooms.
+func takeOwnerSummary(ctx context.Context, owner id.UserID) *OwnerSummary {
+	if rds == nil {
+		ownerPendingLock.Lock()
+		defer ownerPendingLock.Unlock()
+		delete(ownerDeleted, owner)
+		summary, ok := ownerSummaries[owner]
+		if !ok {
+			return &OwnerSummary{}
+		}
+		delete(ownerSummaries, owner)
+		return summary
+	}
+	ownerID := ownerRedisID(owner)
+	summaryKey := queueKey(ctx, ownerSummaryKeyPrefix+ownerID)
+	failuresKey := queueKey(ctx, ownerFailuresKeyPrefix+ownerID)
+	pipe := rds.TxPipeline()
+	countsCmd := pipe.HGetAll(ctx, summaryKey)
+	failuresCmd := pipe.LRange(ctx, failuresKey, 0, -1)
+	pipe.Del(ctx, summaryKey, failuresKey, queueKey(ctx, ownerDeletedKeyPrefix+ownerID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		queueLog.Warnfln("Failed to get summary of %s: %v", owner, err)
+		return &OwnerSummary{}
+	}
+	var summary OwnerSummary
+	counts := countsCmd.Val()
+	summary.Deleted, _ = strconv.ParseInt(counts[string(AuditEventDeleted)], 10, 64)
+	summary.Failed, _ = strconv.ParseInt(counts[string(AuditEventFailed)], 10, 64)
+	summary.Restored, _ = strconv.ParseInt(counts[string(AuditEventRestored)], 10, 64)
+	summary.FullCleanup = counts[ownerFullCleanupField] == "1"
+	for _, item := range failuresCmd.Val() {
+		var failure RoomFailure
+		if err := decodeQueueItem(item, &failure); err == nil {
+			summary.Failures = append(summary.Failures, failure)
+		}
+	}
+	return &summary
+}
+
+// checkOwnerDrained sends the owner drained notifications if the given bridge bot has no rooms left in the queues.
+//
+// This is called when a clean_all request finishes, as rooms may have been processed before the request finished queuing all of them.
+func checkOwnerDrained(ctx context.Context, owner id.UserID) {
+	count, err := GetOwnerPending(ctx, owner)
+	if err != nil {
+		queueLog.Warnfln("Failed to get pending room count of %s: %v", owner, err)
+	} else if count <= 0 {
+		onOwnerDrained(ctx, owner)
+	}
+}
+
+func onOwnerDrained(ctx context.Context, owner id.UserID) {
+	summary := takeOwnerSummary(ctx, owner)
+	queueLog.With(LogFields{"owner": owner}).Infofln("All queued rooms of %s have been processed (%d deleted, %d failed, %d restored)",
+		owner, summary.Deleted, summary.Failed, summary.Restored)
+	SendWebhook(ctx, WebhookOwnerDrained, WebhookPayload{Owner: owner, Summary: summary})
+	go NotifyOwner(detachContext(ctx), owner, summary)
+	queueMediaCleanupAfterDrain(ctx, owner, summary)
+	deactivateGhostsAfterDrain(ctx, owner, summary)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/id"
+)
+
+// roomQuotaKeyPrefix is the prefix of the redis counters containing the number of rooms a bridge bot queued in an hour.
+const roomQuotaKeyPrefix = "yeetserv:room_quota:"
+
+// LimitExceededError is returned when a bridge bot has hit a rate limit or quota.
+type LimitExceededError struct {
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (err *LimitExceededError) Error() string {
+	return fmt.Sprintf("%s limit exceeded, retry after %v", err.Limit, err.RetryAfter)
+}
+
+// RespLimitExceeded is the body of M_LIMIT_EXCEEDED errors.
+type RespLimitExceeded struct {
+	ErrorCode    appservice.ErrorCode `json:"errcode"`
+	Message      string               `json:"error"`
+	RetryAfterMS int64                `json:"retry_after_ms"`
+}
+
+// Write sends the error as a M_LIMIT_EXCEEDED response.
+func (err *LimitExceededError) Write(w http.ResponseWriter) {
+	retryAfterMS := err.RetryAfter.Milliseconds()
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Retry-After", strconv.FormatInt(int64(math.Ceil(err.RetryAfter.Seconds())), 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(&RespLimitExceeded{
+		ErrorCode:    "M_LIMIT_EXCEEDED",
+		Message:      fmt.Sprintf("Too many requests (%s limit)", err.Limit),
+		RetryAfterMS: retryAfterMS,
+	})
+}
+
+var promRateLimitedCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "yeetserv_rate_limited_total",
+		Help: "Number of requests rejected by the rate limits and quotas",
+	},
+	[]string{"bridge", "limit"},
+)
+
+func newLimitExceeded(owner id.UserID, limit string, retryAfter time.Duration) *LimitExceededError {
+	promRateLimitedCounter.WithLabelValues(bridgeLabel(owner), limit).Inc()
+	return &LimitExceededError{Limit: limit, RetryAfter: retryAfter}
+}
+
+// rateLimitBucket is a token bucket of the request rate limit.
+type rateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitLock is the mutex used to lock reading/writing the rateLimitBuckets map.
+var rateLimitLock sync.Mutex
+
+// rateLimitBuckets contains the request rate limit token bucket of each bridge bot.
+var rateLimitBuckets = make(map[id.UserID]*rateLimitBucket)
+
+// CheckRateLimit takes a request from the rate limit of the given bridge bot.
+func CheckRateLimit(owner id.UserID) *LimitExceededError {
+	if cfg.RateLimitPerMinute <= 0 {
+		return nil
+	}
+	perSecond := float64(cfg.RateLimitPerMinute) / 60
+	burst := float64(cfg.RateLimitBurst)
+	now := time.Now()
+
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	bucket, ok := rateLimitBuckets[owner]
+	if !ok {
+		bucket = &rateLimitBucket{tokens: burst, updated: now}
+		rateLimitBuckets[owner] = bucket
+	} else {
+		bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*perSecond)
+		bucket.updated = now
+	}
+	if bucket.tokens < 1 {
+		retryAfter := time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+		return newLimitExceeded(owner, "request rate", retryAfter)
+	}
+	bucket.tokens--
+	return nil
+}
+
+// roomQuotaUsage is the number of rooms a bridge bot queued in the current hour when not using redis.
+type roomQuotaUsage struct {
+	window time.Time
+	used   int64
+}
+
+// roomQuotaLock is the mutex used to lock reading/writing the roomQuotas map.
+var roomQuotaLock sync.Mutex
+
+// roomQuotas contains the room quota usage of each bridge bot when not using redis.
+var roomQuotas = make(map[id.UserID]*roomQuotaUsage)
+
+func roomQuotaKey(ctx context.Context, owner id.UserID, window time.Time) string {
+	return queueKey(ctx, fmt.Sprintf("%s%s:%d", roomQuotaKeyPrefix, ownerRedisID(owner), window.Unix()))
+}
+
+// AddRoomQuota adds the given number of rooms to the hourly room quota usage of the given bridge bot and returns the new usage.
+//
+// The count can be negative to return unused rooms to the quota.
+func AddRoomQuota(ctx context.Context, owner id.UserID, count int64) (int64, error) {
+	if cfg.RoomQuotaPerHour <= 0 || count == 0 {
+		return 0, nil
+	}
+	window := time.Now().Truncate(time.Hour)
+	if rds != nil {
+		key := roomQuotaKey(ctx, owner, window)
+		pipe := rds.TxPipeline()
+		usedCmd := pipe.IncrBy(ctx, key, count)
+		pipe.Expire(ctx, key, 2*time.Hour)
+		_, err := pipe.Exec(ctx)
+		return usedCmd.Val(), err
+	}
+	roomQuotaLock.Lock()
+	defer roomQuotaLock.Unlock()
+	usage, ok := roomQuotas[owner]
+	if !ok || !usage.window.Equal(window) {
+		usage = &roomQuotaUsage{window: window}
+		roomQuotas[owner] = usage
+	}
+	usage.used += count
+	return usage.used, nil
+}
+
+// ReserveRoomQuota adds the given number of rooms to the quota usage of the given bridge bot
+// if the quota has room for all of them.
+//
+// If the rooms don't fit, the usage is not changed and an error is returned with the time until the next hour.
+// A count of zero only checks that the quota isn't used up already. If the quota can't be read, the rooms are allowed.
+func ReserveRoomQuota(ctx context.Context, owner id.UserID, count int64) *LimitExceededError {
+	if cfg.RoomQuotaPerHour <= 0 {
+		return nil
+	}
+	reserve := count
+	if reserve == 0 {
+		// Check for space for one room without keeping it
+		reserve = 1
+	}
+	used, err := AddRoomQuota(ctx, owner, reserve)
+	if err != nil {
+		logFromContext(ctx).Warnfln("Failed to update room quota of %s: %v", owner, err)
+		return nil
+	}
+	if used > cfg.RoomQuotaPerHour || count == 0 {
+		if _, err = AddRoomQuota(ctx, owner, -reserve); err != nil {
+			logFromContext(ctx).Warnfln("Failed to return %d rooms to the quota of %s: %v", reserve, owner, err)
+		}
+	}
+	if used > cfg.RoomQuotaPerHour {
+		now := time.Now()
+		return newLimitExceeded(owner, "hourly room", now.Truncate(time.Hour).Add(time.Hour).Sub(now))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisMode is the type of redis deployment that yeetserv connects to.
+type RedisMode string
+
+const (
+	RedisModeSingle   RedisMode = "single"
+	RedisModeSentinel RedisMode = "sentinel"
+	RedisModeCluster  RedisMode = "cluster"
+)
+
+// RedisOptions are the connection options parsed from REDIS_URL.
+type RedisOptions struct {
+	Mode RedisMode
+	// Network is tcp, or unix for unix:// URLs. It's only used in single mode.
+	Network string
+	redis.UniversalOptions
+}
+
+// parseRedisDuration parses a timeout query parameter, which is either a Go duration or a number of seconds.
+func parseRedisDuration(name, val string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(val); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	} else if duration, err := time.ParseDuration(val); err == nil {
+		return duration, nil
+	}
+	return 0, fmt.Errorf("invalid %s %q", name, val)
+}
+
+// parseRedisURL parses REDIS_URL with the same semantics as redis.ParseURL
+// (`redis://`, `rediss://` for TLS or `unix://`, with credentials and the database number),
+// plus query parameters for timeouts, the connection pool, Sentinel and Cluster.
+func parseRedisURL(rawURL string) (*RedisOptions, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	query := parsed.Query()
+	// Pass the remaining query parameters to redis.ParseURL, which only supports db for unix sockets
+	parsed.RawQuery = ""
+	if parsed.Scheme == "unix" && query.Has("db") {
+		parsed.RawQuery = url.Values{"db": {query.Get("db")}}.Encode()
+		query.Del("db")
+	}
+	baseOpts, err := redis.ParseURL(parsed.String())
+	if err != nil {
+		return nil, err
+	}
+	opts := &RedisOptions{
+		Mode:    RedisModeSingle,
+		Network: baseOpts.Network,
+		UniversalOptions: redis.UniversalOptions{
+			Addrs:     []string{baseOpts.Addr},
+			DB:        baseOpts.DB,
+			Username:  baseOpts.Username,
+			Password:  baseOpts.Password,
+			TLSConfig: baseOpts.TLSConfig,
+		},
+	}
+	cluster := false
+	for name, vals := range query {
+		val := vals[len(vals)-1]
+		switch name {
+		case "addr":
+			opts.Addrs = append(opts.Addrs, vals...)
+		case "master_name":
+			opts.MasterName = val
+		case "cluster":
+			cluster = isTruthy(val)
+		case "sentinel_password":
+			opts.SentinelPassword = val
+		case "dial_timeout":
+			opts.DialTimeout, err = parseRedisDuration(name, val)
+		case "read_timeout":
+			opts.ReadTimeout, err = parseRedisDuration(name, val)
+		case "write_timeout":
+			opts.WriteTimeout, err = parseRedisDuration(name, val)
+		case "pool_size":
+			opts.PoolSize, err = strconv.Atoi(val)
+		case "min_idle_conns":
+			opts.MinIdleConns, err = strconv.Atoi(val)
+		case "max_retries":
+			opts.MaxRetries, err = strconv.Atoi(val)
+		case "skip_verify":
+			if opts.TLSConfig == nil {
+				return nil, fmt.Errorf("skip_verify requires the rediss scheme")
+			}
+			opts.TLSConfig.InsecureSkipVerify = isTruthy(val)
+		default:
+			return nil, fmt.Errorf("unknown query parameter %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	if len(opts.MasterName) > 0 && cluster {
+		return nil, fmt.Errorf("master_name and cluster can't be used together")
+	} else if len(opts.MasterName) > 0 {
+		opts.Mode = RedisModeSentinel
+	} else if cluster {
+		opts.Mode = RedisModeCluster
+	}
+	if opts.Mode == RedisModeCluster && opts.DB != 0 {
+		return nil, fmt.Errorf("redis cluster only supports database 0")
+	} else if opts.Mode == RedisModeSingle && len(opts.Addrs) > 1 {
+		return nil, fmt.Errorf("addr can only be used with master_name or cluster")
+	} else if opts.Mode != RedisModeSingle && opts.Network == "unix" {
+		return nil, fmt.Errorf("unix sockets can't be used with master_name or cluster")
+	}
+	if opts.TLSConfig != nil && opts.Mode != RedisModeSingle {
+		// The server name from the URL host doesn't match the other nodes
+		opts.TLSConfig = &tls.Config{InsecureSkipVerify: opts.TLSConfig.InsecureSkipVerify}
+	}
+	return opts, nil
+}
+
+// newRedisClient creates a client for the configured redis deployment.
+func newRedisClient(opts *RedisOptions) redis.UniversalClient {
+	switch opts.Mode {
+	case RedisModeSentinel:
+		return redis.NewFailoverClient(opts.Failover())
+	case RedisModeCluster:
+		return redis.NewClusterClient(opts.Cluster())
+	default:
+		simpleOpts := opts.Simple()
+		simpleOpts.Network = opts.Network
+		return redis.NewClient(simpleOpts)
+	}
+}
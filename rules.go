@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"regexp"
 	"strings"
 
 	"maunium.net/go/mautrix"
@@ -11,9 +10,25 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
-// AllowedLocalpartRegex is the regex matching localparts of users who are allowed to use the cleanup service.
+// DefaultAllowedLocalpartRegex is the default regex matching localparts of users who are allowed to use the cleanup service.
 // The default regex here matches mautrix-asmux bridge bots and the idea is to call the service with the as_token.
-var AllowedLocalpartRegex = regexp.MustCompile("^_([a-z0-9-]+)_([a-z0-9-]+)_bot$")
+// It can be changed with the ALLOWED_LOCALPART_REGEX setting.
+const DefaultAllowedLocalpartRegex = "^_([a-z0-9-]+)_([a-z0-9-]+)_bot$"
+
+// RuleRejection is the error returned when the rules don't allow cleaning up a room or using the service.
+type RuleRejection struct {
+	// Reason is a short machine-readable reason, used as a metric label.
+	Reason  string
+	Message string
+}
+
+func (rr *RuleRejection) Error() string {
+	return rr.Message
+}
+
+func newRuleRejection(reason, message string, args ...interface{}) *RuleRejection {
+	return &RuleRejection{Reason: reason, Message: fmt.Sprintf(message, args...)}
+}
 
 // IsAllowedToUseService checks if the given user can use this cleanup service.
 func IsAllowedToUseService(ctx context.Context, client *mautrix.Client, whoami *mautrix.RespWhoami) error {
@@ -21,19 +36,35 @@ func IsAllowedToUseService(ctx context.Context, client *mautrix.Client, whoami *
 	localpart, _, err := client.UserID.Parse()
 	if err != nil {
 		return fmt.Errorf("failed to parse user ID: %w", err)
-	} else if !AllowedLocalpartRegex.MatchString(localpart) {
-		return fmt.Errorf("only bridge bots can clean up rooms")
+	} else if !getAllowedLocalpartRegex().MatchString(localpart) {
+		return newRuleRejection("not_bridge_bot", "only bridge bots can clean up rooms")
 	}
 	return nil
 }
 
+// masqueradeClient copies the given appservice client and sets AppServiceUserID so that requests are made as the given user.
+func masqueradeClient(client *mautrix.Client, userID id.UserID) *mautrix.Client {
+	return &mautrix.Client{
+		AppServiceUserID: userID,
+
+		AccessToken:   client.AccessToken,
+		UserAgent:     client.UserAgent,
+		HomeserverURL: client.HomeserverURL,
+		UserID:        client.UserID,
+		Client:        client.Client,
+		Prefix:        client.Prefix,
+		Store:         client.Store,
+		Logger:        client.Logger,
+	}
+}
+
 func parseBridgeName(userID id.UserID) (bridgeUserLocalpart, bridgeName, homeserver string, err error) {
 	var botLocalpart string
 	// Parsing and the allowed localpart check should never fail at this point since
 	// they're also checked in IsAllowedToUseService, but handle them just in case anyway.
 	if botLocalpart, homeserver, err = userID.Parse(); err != nil {
 		err = fmt.Errorf("failed to parse user ID: %w", err)
-	} else if parts := AllowedLocalpartRegex.FindStringSubmatch(botLocalpart); len(parts) != 3 {
+	} else if parts := getAllowedLocalpartRegex().FindStringSubmatch(botLocalpart); len(parts) != 3 {
 		err = fmt.Errorf("didn't get expected number of parts from parsing user ID localpart")
 	} else {
 		bridgeUserLocalpart = parts[1]
@@ -42,13 +73,42 @@ func parseBridgeName(userID id.UserID) (bridgeUserLocalpart, bridgeName, homeser
 	return
 }
 
+// bridgeBotClient returns a client that makes requests as the given bridge bot using ASMUX_AS_TOKEN,
+// for checking the rules in admin requests.
+func bridgeBotClient(botID id.UserID) *mautrix.Client {
+	client := masqueradeClient(asmuxClient, botID)
+	client.UserID = botID
+	return client
+}
+
+// findBridgeUsersInRoom returns the members of the room that are the user of the given bridge bot,
+// which are the users that IsAllowedToCleanRoom would kick, without checking the rules.
+func findBridgeUsersInRoom(ctx context.Context, owner id.UserID, roomID id.RoomID) ([]id.UserID, error) {
+	bridgeUserLocalpart, _, homeserver, err := parseBridgeName(owner)
+	if err != nil {
+		return nil, err
+	}
+	members, err := adminListRoomMembers(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get members of %s: %w", roomID, err)
+	}
+	var bridgeUsers []id.UserID
+	for _, member := range members {
+		memberLocalpart, memberHomeserver, _ := member.Parse()
+		if memberHomeserver == homeserver && memberLocalpart == bridgeUserLocalpart {
+			bridgeUsers = append(bridgeUsers, member)
+		}
+	}
+	return bridgeUsers, nil
+}
+
 // IsAllowedToCleanRoom checks if the given client has sufficient permissions in the room to include it in the cleanup.
 //
-// It returns the list of user IDs that should be kicked right away.
-func IsAllowedToCleanRoom(ctx context.Context, client *mautrix.Client, roomID id.RoomID) ([]id.UserID, error) {
+// It returns the list of user IDs that should be kicked right away and a description of the rule that allowed the cleanup.
+func IsAllowedToCleanRoom(ctx context.Context, client *mautrix.Client, roomID id.RoomID) ([]id.UserID, string, error) {
 	bridgeUserLocalpart, bridgeName, homeserver, err := parseBridgeName(client.UserID)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	// The localpart prefix for ghost users managed by the bridge.
 	bridgeGhostPrefix := fmt.Sprintf("_%s_%s_", bridgeUserLocalpart, bridgeName)
@@ -56,58 +116,47 @@ func IsAllowedToCleanRoom(ctx context.Context, client *mautrix.Client, roomID id
 	var randomBridgeGhostInRoom id.UserID
 	members, err := adminListRoomMembers(ctx, roomID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get members of %s: %w", roomID, err)
+		return nil, "", fmt.Errorf("failed to get members of %s: %w", roomID, err)
 	}
 	var usersToKick []id.UserID
 	// Make sure the room doesn't contain anyone except the user of the bridge, the bridge bot and bridge ghosts.
 	for _, member := range members {
 		memberLocalpart, memberHomeserver, _ := member.Parse()
 		if memberHomeserver != homeserver {
-			return nil, fmt.Errorf("room contains member '%s' from other homeserver '%s' (expected '%s')", member, memberHomeserver, homeserver)
+			return nil, "", newRuleRejection("remote_member", "room contains member '%s' from other homeserver '%s' (expected '%s')", member, memberHomeserver, homeserver)
 		} else if memberLocalpart == bridgeUserLocalpart {
 			// Found the bridge user, so schedule that user to be kicked from the room.
 			usersToKick = append(usersToKick, member)
 		} else if strings.HasPrefix(memberLocalpart, bridgeGhostPrefix) {
 			randomBridgeGhostInRoom = member
 		} else {
-			return nil, fmt.Errorf("room contains member '%s' that is not the bridge user nor a bridge ghost (expected '%s' or prefix '%s')", member, bridgeUserLocalpart, bridgeGhostPrefix)
+			return nil, "", newRuleRejection("non_bridge_member", "room contains member '%s' that is not the bridge user nor a bridge ghost (expected '%s' or prefix '%s')", member, bridgeUserLocalpart, bridgeGhostPrefix)
 		}
 	}
 
-	// Copy the client and set AppServiceUserID to sure the power level request
-	// is always done by a user in the room.
-	appserviceClient := &mautrix.Client{
-		AppServiceUserID: randomBridgeGhostInRoom,
-
-		AccessToken:   client.AccessToken,
-		UserAgent:     client.UserAgent,
-		HomeserverURL: client.HomeserverURL,
-		UserID:        client.UserID,
-		Client:        client.Client,
-		Prefix:        client.Prefix,
-		Store:         client.Store,
-		Logger:        client.Logger,
-	}
+	// Use AppServiceUserID to make sure the power level request is always done by a user in the room.
+	appserviceClient := masqueradeClient(client, randomBridgeGhostInRoom)
 
 	var pl event.PowerLevelsEventContent
 	err = appserviceClient.StateEvent(roomID, event.StatePowerLevels, "", &pl)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get power levels of %s: %w", roomID, err)
+		return nil, "", fmt.Errorf("failed to get power levels of %s: %w", roomID, err)
 	}
 	// Make sure that the bridge bot or at least one bridged user has PL 100.
+	decision := "only bridge members and bridge bot has admin power level"
 	if pl.GetUserLevel(client.UserID) < 100 {
-		found := false
+		decision = ""
 		for userID, level := range pl.Users {
 			if level >= 100 && strings.HasPrefix(userID.String(), "@"+bridgeGhostPrefix) {
-				found = true
+				decision = fmt.Sprintf("only bridge members and bridge ghost %s has admin power level", userID)
 				break
 			}
 		}
-		if !found {
-			return nil, fmt.Errorf("room doesn't have any bridge user with admin power level")
+		if len(decision) == 0 {
+			return nil, "", newRuleRejection("no_bridge_admin", "room doesn't have any bridge user with admin power level")
 		}
 	}
 
 	// All good, room is safe to delete.
-	return usersToKick, nil
+	return usersToKick, decision, nil
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"maunium.net/go/mautrix/id"
+)
+
+// ScheduleOptions are the request fields for choosing when the rooms in the request are deleted.
+//
+// If neither is set, rooms are deleted after POSTPONE_DELETION.
+type ScheduleOptions struct {
+	// DeleteAfter is how long to wait before deleting the rooms, as a Go duration string (e.g. "72h").
+	DeleteAfter string `json:"delete_after,omitempty"`
+	// DeleteAt is the unix millisecond timestamp when the rooms should be deleted.
+	DeleteAt int64 `json:"delete_at,omitempty"`
+}
+
+// DueTime returns the time when rooms should be deleted, or a zero time if the request didn't specify one.
+func (opts *ScheduleOptions) DueTime() (time.Time, error) {
+	if len(opts.DeleteAfter) > 0 && opts.DeleteAt != 0 {
+		return time.Time{}, fmt.Errorf("delete_after and delete_at can't be used together")
+	} else if len(opts.DeleteAfter) > 0 {
+		deleteAfter, err := time.ParseDuration(opts.DeleteAfter)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid delete_after: %w", err)
+		} else if deleteAfter < 0 {
+			return time.Time{}, fmt.Errorf("delete_after must not be negative")
+		}
+		return time.Now().Add(deleteAfter), nil
+	} else if opts.DeleteAt != 0 {
+		return time.UnixMilli(opts.DeleteAt), nil
+	}
+	return time.Time{}, nil
+}
+
+// popDueScript atomically removes and returns the first member of a sorted set if its score is at most ARGV[1].
+var popDueScript = redis.NewScript(`
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1)
+if #items == 0 then
+	return false
+end
+redis.call('ZREM', KEYS[1], items[1])
+return items[1]
+`)
+
+// migrateLegacyDeleteQueue moves rooms from the old FIFO delete queue list into the delete schedule.
+//
+// Legacy plain room ID entries are kept as-is with a score of zero so that they're deleted immediately.
+func migrateLegacyDeleteQueue(ctx context.Context) error {
+	items, err := rds.LRange(ctx, queueKey(ctx, legacyDeleteQueueKey), 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read legacy delete queue: %w", err)
+	} else if len(items) == 0 {
+		return nil
+	}
+	members := make([]*redis.Z, len(items))
+	for i, item := range items {
+		var score float64
+		pendingRoom := &PendingRoom{}
+		if err = decodeQueueItem(item, pendingRoom); err == nil && !pendingRoom.QueueTime.IsZero() {
+			score = float64(pendingRoom.QueueTime.Add(getPostponeDeletion()).UnixMilli())
+		}
+		members[i] = &redis.Z{Score: score, Member: item}
+	}
+	// Only trim the items that were read, in case an old instance pushed more in the meantime
+	pipe := rds.TxPipeline()
+	pipe.ZAdd(ctx, queueKey(ctx, deleteScheduleKey), members...)
+	pipe.LTrim(ctx, queueKey(ctx, legacyDeleteQueueKey), int64(len(items)), -1)
+	if _, err = pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to move legacy delete queue items: %w", err)
+	}
+	queueLog.Infoln("Moved", len(items), "rooms from the legacy delete queue to the delete schedule")
+	return nil
+}
+
+func pushRedisSchedule(ctx context.Context, pendingRoom *PendingRoom) error {
+	data, err := encodeQueueItem(pendingRoom)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s to redis: %w", pendingRoom.RoomID, err)
+	}
+	err = rds.ZAdd(ctx, queueKey(ctx, deleteScheduleKey), &redis.Z{
+		Score:  float64(pendingRoom.DueTime.UnixMilli()),
+		Member: data,
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to push %s to redis: %w", pendingRoom.RoomID, err)
+	}
+	return nil
+}
+
+// parseScheduleItem parses a delete schedule entry. Entries that aren't JSON are legacy plain room IDs.
+//
+// An error is only returned for encrypted entries that can't be decrypted.
+func parseScheduleItem(item string) (*PendingRoom, error) {
+	pendingRoom := &PendingRoom{}
+	if err := decodeQueueItem(item, pendingRoom); err != nil {
+		if isEncrypted(item) {
+			return nil, err
+		}
+		return &PendingRoom{RoomID: id.RoomID(item)}, nil
+	}
+	return pendingRoom, nil
+}
+
+// undecryptableRetryDelay is how long delete schedule entries that can't be decrypted are postponed.
+const undecryptableRetryDelay = 1 * time.Hour
+
+// popRedisSchedule removes and returns the room in the delete schedule with the earliest due time, if it's due.
+func popRedisSchedule(ctx context.Context) (*PendingRoom, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	item, err := popDueScript.Run(ctx, rds, []string{queueKey(ctx, deleteScheduleKey)}, now).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	pendingRoom, err := parseScheduleItem(item)
+	if err != nil {
+		// Keep the entry in case the key is added back to QUEUE_ENCRYPTION_OLD_KEYS
+		retryErr := rds.ZAdd(ctx, queueKey(ctx, deleteScheduleKey), &redis.Z{
+			Score:  float64(time.Now().Add(undecryptableRetryDelay).UnixMilli()),
+			Member: item,
+		}).Err()
+		if retryErr != nil {
+			return nil, fmt.Errorf("failed to decrypt delete schedule entry (%v) and to put it back: %w", err, retryErr)
+		}
+		return nil, fmt.Errorf("failed to decrypt delete schedule entry, retrying in %v: %w", undecryptableRetryDelay, err)
+	}
+	pendingRoom.DryRun = isDryRunContext(ctx)
+	return pendingRoom, nil
+}
+
+// peekRedisSchedule returns the room in the delete schedule with the earliest due time without removing it.
+func peekRedisSchedule(ctx context.Context) (*PendingRoom, error) {
+	items, err := rds.ZRange(ctx, queueKey(ctx, deleteScheduleKey), 0, 0).Result()
+	if err != nil {
+		return nil, err
+	} else if len(items) == 0 {
+		return nil, nil
+	}
+	return parseScheduleItem(items[0])
+}
+
+// removeFromRedisSchedule removes the given room from the delete schedule and returns the removed entries.
+func removeFromRedisSchedule(ctx context.Context, roomID id.RoomID) ([]*PendingRoom, error) {
+	items, err := rds.ZRange(ctx, queueKey(ctx, deleteScheduleKey), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delete schedule from redis: %w", err)
+	}
+	var removed []*PendingRoom
+	for _, item := range items {
+		pendingRoom, err := parseScheduleItem(item)
+		if err != nil || pendingRoom.RoomID != roomID {
+			continue
+		}
+		count, err := rds.ZRem(ctx, queueKey(ctx, deleteScheduleKey), item).Result()
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove %s from redis: %w", roomID, err)
+		} else if count > 0 {
+			removed = append(removed, pendingRoom)
+		}
+	}
+	return removed, nil
+}
+
+// removeOwnerFromRedisSchedule removes all rooms of the given bridge bot from the delete schedule.
+func removeOwnerFromRedisSchedule(ctx context.Context, owner id.UserID) ([]*PendingRoom, error) {
+	items, err := rds.ZRange(ctx, queueKey(ctx, deleteScheduleKey), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delete schedule from redis: %w", err)
+	}
+	var removed []*PendingRoom
+	for _, item := range items {
+		pendingRoom, err := parseScheduleItem(item)
+		if err != nil || pendingRoom.Owner != owner {
+			continue
+		}
+		count, err := rds.ZRem(ctx, queueKey(ctx, deleteScheduleKey), item).Result()
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove %s from redis: %w", pendingRoom.RoomID, err)
+		} else if count > 0 {
+			removed = append(removed, pendingRoom)
+		}
+	}
+	return removed, nil
+}
+
+// pendingRoomHeap is a min-heap of rooms ordered by due time, used as the delete queue when not using redis.
+type pendingRoomHeap []*PendingRoom
+
+func (h pendingRoomHeap) Len() int            { return len(h) }
+func (h pendingRoomHeap) Less(i, j int) bool  { return h[i].DueTime.Before(h[j].DueTime) }
+func (h pendingRoomHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pendingRoomHeap) Push(x interface{}) { *h = append(*h, x.(*PendingRoom)) }
+func (h *pendingRoomHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// memorySchedule is the in-memory delete queue.
+type memorySchedule struct {
+	lock  sync.Mutex
+	rooms pendingRoomHeap
+}
+
+func (sched *memorySchedule) Push(pendingRoom *PendingRoom) int {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+	heap.Push(&sched.rooms, pendingRoom)
+	return len(sched.rooms)
+}
+
+// PopDue removes and returns the room with the earliest due time, if it's due.
+func (sched *memorySchedule) PopDue() (*PendingRoom, int) {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+	if len(sched.rooms) == 0 || sched.rooms[0].DueTime.After(time.Now()) {
+		return nil, len(sched.rooms)
+	}
+	pendingRoom := heap.Pop(&sched.rooms).(*PendingRoom)
+	return pendingRoom, len(sched.rooms)
+}
+
+// Peek returns the room with the earliest due time without removing it.
+func (sched *memorySchedule) Peek() *PendingRoom {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+	if len(sched.rooms) == 0 {
+		return nil
+	}
+	return sched.rooms[0]
+}
+
+func (sched *memorySchedule) Len() int {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+	return len(sched.rooms)
+}
+
+// removeMatching removes the rooms that the given function returns true for and returns them.
+func (sched *memorySchedule) removeMatching(match func(*PendingRoom) bool) []*PendingRoom {
+	sched.lock.Lock()
+	defer sched.lock.Unlock()
+	var removed []*PendingRoom
+	remaining := sched.rooms[:0]
+	for _, pendingRoom := range sched.rooms {
+		if match(pendingRoom) {
+			removed = append(removed, pendingRoom)
+		} else {
+			remaining = append(remaining, pendingRoom)
+		}
+	}
+	for i := len(remaining); i < len(sched.rooms); i++ {
+		sched.rooms[i] = nil
+	}
+	sched.rooms = remaining
+	heap.Init(&sched.rooms)
+	return removed
+}
+
+// Remove removes the given room and returns the removed entries.
+func (sched *memorySchedule) Remove(roomID id.RoomID) []*PendingRoom {
+	return sched.removeMatching(func(pendingRoom *PendingRoom) bool {
+		return pendingRoom.RoomID == roomID
+	})
+}
+
+// RemoveOwner removes all rooms of the given bridge bot and returns them.
+func (sched *memorySchedule) RemoveOwner(owner id.UserID) []*PendingRoom {
+	return sched.removeMatching(func(pendingRoom *PendingRoom) bool {
+		return pendingRoom.Owner == owner
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomSnapshot is the data that is saved about a room before it's deleted.
+type RoomSnapshot struct {
+	RoomID  id.RoomID         `json:"room_id"`
+	Owner   id.UserID         `json:"owner,omitempty"`
+	Time    time.Time         `json:"time"`
+	Details json.RawMessage   `json:"details"`
+	State   []json.RawMessage `json:"state"`
+	Members []id.UserID       `json:"members"`
+	Aliases []id.RoomAlias    `json:"aliases"`
+}
+
+// snapshotEnabled returns true if either a local directory or an S3 bucket is configured for room snapshots.
+func snapshotEnabled() bool {
+	return len(cfg.SnapshotDir) > 0 || len(cfg.SnapshotS3Bucket) > 0
+}
+
+// SnapshotRoom fetches the current state of the room using the admin API and saves it as gzipped JSON.
+//
+// If SNAPSHOT_S3_BUCKET is set, the snapshot is uploaded there, otherwise it's written to SNAPSHOT_DIR.
+func SnapshotRoom(ctx context.Context, pendingRoom *PendingRoom) error {
+	snapshot := RoomSnapshot{
+		RoomID: pendingRoom.RoomID,
+		Owner:  pendingRoom.Owner,
+		Time:   time.Now(),
+	}
+	var err error
+	if snapshot.Details, err = adminGetRoomDetails(ctx, pendingRoom.RoomID); err != nil {
+		return fmt.Errorf("failed to get room details: %w", err)
+	} else if snapshot.State, err = adminGetRoomState(ctx, pendingRoom.RoomID); err != nil {
+		return fmt.Errorf("failed to get room state: %w", err)
+	} else if snapshot.Members, err = adminListRoomMembers(ctx, pendingRoom.RoomID); err != nil {
+		return fmt.Errorf("failed to get room members: %w", err)
+	}
+	aliases, err := adminClient.GetAliases(pendingRoom.RoomID)
+	if err != nil {
+		return fmt.Errorf("failed to get room aliases: %w", err)
+	}
+	snapshot.Aliases = aliases.Aliases
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err = json.NewEncoder(zw).Encode(&snapshot); err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	} else if err = zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress snapshot: %w", err)
+	}
+
+	owner := "unknown"
+	if len(pendingRoom.Owner) > 0 {
+		owner = pendingRoom.Owner.String()
+	}
+	name := fmt.Sprintf("%s.json.gz", pendingRoom.RoomID)
+	if len(cfg.SnapshotS3Bucket) > 0 {
+		return uploadSnapshotS3(ctx, owner+"/"+name, buf.Bytes())
+	}
+	dir := filepath.Join(cfg.SnapshotDir, owner)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	} else if err = os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+	return nil
+}
+
+// s3Escape percent-encodes everything except unreserved characters and slashes, as required for AWS signature v4 paths.
+func s3Escape(val string) string {
+	var buf strings.Builder
+	for _, c := range []byte(val) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || strings.IndexByte("-_.~/", c) >= 0 {
+			buf.WriteByte(c)
+		} else {
+			_, _ = fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uploadSnapshotS3 uploads the given data to an S3-compatible bucket using a path-style URL and AWS signature v4.
+func uploadSnapshotS3(ctx context.Context, key string, data []byte) error {
+	path := "/" + s3Escape(cfg.SnapshotS3Bucket) + "/" + s3Escape(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimRight(cfg.SnapshotS3Endpoint, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to prepare request: %w", err)
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(data)
+	payloadHashHex := hex.EncodeToString(payloadHash[:])
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Header.Set("X-Amz-Content-Sha256", payloadHashHex)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		http.MethodPut,
+		path,
+		"",
+		"content-type:application/gzip",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHashHex,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHashHex,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, cfg.SnapshotS3Region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+cfg.SnapshotS3Secret), date)
+	signingKey = hmacSHA256(signingKey, cfg.SnapshotS3Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", cfg.SnapshotS3Access, scope, signedHeaders, signature))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"maunium.net/go/mautrix"
+)
+
+// runningLoopsLock is the mutex used to lock reading/writing the runningLoops map.
+var runningLoopsLock sync.Mutex
+
+// runningLoops contains the background loops that have been started and whether they're still running.
+var runningLoops = make(map[string]bool)
+
+// lastDeleteTime is the unix millisecond timestamp of the last successful room deletion.
+var lastDeleteTime int64
+
+func setLoopRunning(name string, running bool) {
+	runningLoopsLock.Lock()
+	runningLoops[name] = running
+	runningLoopsLock.Unlock()
+}
+
+func getRunningLoops() (loops map[string]bool, allRunning bool) {
+	runningLoopsLock.Lock()
+	defer runningLoopsLock.Unlock()
+	loops = make(map[string]bool, len(runningLoops))
+	allRunning = true
+	for name, running := range runningLoops {
+		loops[name] = running
+		allRunning = allRunning && running
+	}
+	return
+}
+
+func markDeleteSuccess() {
+	atomic.StoreInt64(&lastDeleteTime, time.Now().UnixMilli())
+}
+
+type RespHealth struct {
+	Loops map[string]bool `json:"loops"`
+}
+
+// handleHealth is the liveness check, which fails if any of the background loops have stopped.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	loops, allRunning := getRunningLoops()
+	w.Header().Add("Content-Type", "application/json")
+	if allRunning {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(&RespHealth{Loops: loops})
+}
+
+type RespReady struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// handleReady is the readiness check, which fails if redis, the asmux database or the Synapse admin API are unavailable.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	resp := RespReady{Ready: true, Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			resp.Ready = false
+			resp.Checks[name] = err.Error()
+		} else {
+			resp.Checks[name] = "ok"
+		}
+	}
+	if rds != nil {
+		check("redis", rds.Ping(ctx).Err())
+	}
+	if asmuxDbPool != nil {
+		check("asmux_database", asmuxDbPool.Ping(ctx))
+	}
+	_, err := adminClient.MakeFullRequest(mautrix.FullRequest{
+		Method:       http.MethodGet,
+		URL:          adminClient.BuildURL("account", "whoami"),
+		ResponseJSON: &mautrix.RespWhoami{},
+		Context:      ctx,
+	})
+	check("synapse_admin", err)
+
+	w.Header().Add("Content-Type", "application/json")
+	if resp.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+type RespStatus struct {
+	LeaveQueueLength  int64  `json:"leave_queue_length"`
+	DeleteQueueLength int64  `json:"delete_queue_length"`
+	ErrorQueueLength  int64  `json:"error_queue_length"`
+	MediaQueueLength  int64  `json:"media_queue_length"`
+	NextDeleteAgeMS   *int64 `json:"next_delete_age_ms,omitempty"`
+	NextDeleteDueTS   int64  `json:"next_delete_due_ts,omitempty"`
+
+	DeletesPaused    bool        `json:"deletes_paused"`
+	LeaveWindowOpen  bool        `json:"leave_window_open"`
+	DeleteWindowOpen bool        `json:"delete_window_open"`
+	DryRun           bool        `json:"dry_run"`
+	ActiveJobs       []*CleanJob `json:"active_jobs"`
+	LastDeleteTS     int64       `json:"last_delete_ts,omitempty"`
+}
+
+// handleStatus returns the current state of the queues and cleanup jobs.
+//
+// It requires an admin API key with the queue:read scope, as the active jobs contain the bridge bots of customers.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	ctx, reqLog := prepareRequest(r)
+	if verifyAdminToken(w, r.Header.Get("Authorization"), ScopeQueueRead) == nil {
+		return
+	}
+	resp := RespStatus{
+		DryRun:           isDryRun(),
+		LeaveWindowOpen:  getLeaveWindows().IsOpen(time.Now()),
+		DeleteWindowOpen: getDeleteWindows().IsOpen(time.Now()),
+		ActiveJobs:       GetActiveJobs(),
+		LastDeleteTS:     atomic.LoadInt64(&lastDeleteTime),
+	}
+	if rds != nil {
+		var err error
+		if resp.LeaveQueueLength, err = rds.LLen(ctx, queueKey(ctx, leaveQueueKey)).Result(); err != nil {
+			reqLog.Warnln("Failed to get leave queue length:", err)
+		}
+		if resp.DeleteQueueLength, err = rds.ZCard(ctx, queueKey(ctx, deleteScheduleKey)).Result(); err != nil {
+			reqLog.Warnln("Failed to get delete queue length:", err)
+		}
+		if resp.ErrorQueueLength, err = rds.LLen(ctx, queueKey(ctx, errorQueueKey)).Result(); err != nil {
+			reqLog.Warnln("Failed to get error queue length:", err)
+		}
+		if resp.MediaQueueLength, err = rds.LLen(ctx, queueKey(ctx, mediaQueueKey)).Result(); err != nil {
+			reqLog.Warnln("Failed to get media queue length:", err)
+		}
+		resp.DeletesPaused = isDeletePaused(ctx)
+	} else {
+		resp.LeaveQueueLength = int64(len(leaveQueue))
+		resp.DeleteQueueLength = int64(deleteSchedule.Len())
+		resp.ErrorQueueLength = atomic.LoadInt64(&memoryErrorQueueLength)
+		resp.MediaQueueLength = int64(len(mediaQueue))
+	}
+	if next, err := peekDeleteQueue(ctx); err != nil {
+		reqLog.Warnln("Failed to peek delete queue:", err)
+	} else if next != nil && !next.QueueTime.IsZero() {
+		age := time.Since(next.QueueTime).Milliseconds()
+		resp.NextDeleteAgeMS = &age
+		if !next.DueTime.IsZero() {
+			resp.NextDeleteDueTS = next.DueTime.UnixMilli()
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(&resp)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+var tracer = otel.Tracer("gitlab.com/beeper/yeetserv")
+
+// tracerProvider is the OpenTelemetry SDK tracer provider. It's nil if tracing is not enabled.
+var tracerProvider *sdktrace.TracerProvider
+
+// httpClient is the client used for non-mautrix HTTP requests. It's instrumented if tracing is enabled.
+var httpClient = http.DefaultClient
+
+// initTracing sets up exporting OpenTelemetry traces over OTLP/HTTP if TRACING_ENDPOINT is set.
+func initTracing() error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if len(cfg.TracingEndpoint) == 0 {
+		return nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.TracingEndpoint))
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("yeetserv"))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	httpClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	return nil
+}
+
+// instrumentHandler wraps the given HTTP handler to create spans for incoming requests if tracing is enabled.
+func instrumentHandler(handler http.Handler) http.Handler {
+	if tracerProvider == nil {
+		return handler
+	}
+	return otelhttp.NewHandler(handler, "yeetserv")
+}
+
+// shutdownTracing flushes any remaining spans to the exporter.
+func shutdownTracing(ctx context.Context) error {
+	if tracerProvider == nil {
+		return nil
+	}
+	return tracerProvider.Shutdown(ctx)
+}
+
+// instrumentClient makes the given mautrix client create spans for its requests if tracing is enabled.
+//
+// Only requests made with a context (i.e. MakeFullRequest) will be children of the current span.
+func instrumentClient(client *mautrix.Client) {
+	if tracerProvider != nil {
+		client.Client.Transport = otelhttp.NewTransport(client.Client.Transport)
+	}
+}
+
+// startSpan starts a new span for a room cleanup stage.
+func startSpan(ctx context.Context, name string, roomID id.RoomID, owner id.UserID) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{attribute.String("room_id", roomID.String())}
+	if len(owner) > 0 {
+		attrs = append(attrs, attribute.String("owner", owner.String()))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// recordSpanError marks the span as failed if the error is not nil.
+func recordSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// endSpan records the error (if any) in the span and ends it.
+func endSpan(span trace.Span, err error) {
+	recordSpanError(span, err)
+	span.End()
+}
+
+// injectTraceContext returns the trace context of the given context so that it can be stored in queue items.
+func injectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTraceContext returns a copy of the given context with the trace context from a queue item.
+func extractTraceContext(ctx context.Context, traceContext map[string]string) context.Context {
+	if len(traceContext) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(traceContext))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+type ReqAdminCleanUser struct {
+	UserID id.UserID `json:"user_id"`
+	DeleteOptions
+	ScheduleOptions
+}
+
+type RespAdminCleanUser struct {
+	// Bridges contains the queued, failed and rejected rooms of each bridge bot of the user.
+	Bridges map[id.UserID]*RespQueueRooms `json:"bridges"`
+	// Unmatched contains the rooms that don't have a ghost or bot of any of the user's bridges.
+	Unmatched []id.RoomID `json:"unmatched"`
+	// Failed contains the rooms whose members couldn't be listed.
+	Failed []id.RoomID `json:"failed"`
+}
+
+// findRoomBridgeBot returns the bot of the bridge of the given user that has a ghost or the bot in the room,
+// or an empty string if none of the members belong to the user's bridges.
+func findRoomBridgeBot(userID id.UserID, members []id.UserID) id.UserID {
+	localpart, homeserver, err := userID.Parse()
+	if err != nil {
+		return ""
+	}
+	prefix := fmt.Sprintf("_%s_", localpart)
+	for _, member := range members {
+		memberLocalpart, memberHomeserver, err := member.Parse()
+		if err != nil || memberHomeserver != homeserver || !strings.HasPrefix(memberLocalpart, prefix) {
+			continue
+		}
+		bridgeName, _, found := strings.Cut(strings.TrimPrefix(memberLocalpart, prefix), "_")
+		if !found || len(bridgeName) == 0 {
+			continue
+		}
+		botID := id.NewUserID(fmt.Sprintf("%s%s_bot", prefix, bridgeName), homeserver)
+		if bridgeUser, parsedBridgeName, _, err := parseBridgeName(botID); err == nil && bridgeUser == localpart && parsedBridgeName == bridgeName {
+			return botID
+		}
+	}
+	return ""
+}
+
+// CleanUserRooms queues all rooms of the given local user that belong to one of the user's bridges for leaving.
+//
+// Each room is checked with the rules using the identity of the bridge bot whose ghosts are in the room.
+// Bridges whose rooms were all queued are marked as fully cleaned up once every room has been checked.
+func CleanUserRooms(ctx context.Context, req *ReqAdminCleanUser, dueTime time.Time, adminKey *AdminAPIKey) (*RespAdminCleanUser, error) {
+	reqLog := logFromContext(ctx)
+	rooms, err := adminListUserRooms(ctx, req.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms of %s: %w", req.UserID, err)
+	}
+	reqLog.Debugln("Found", len(rooms), "rooms of", req.UserID)
+
+	resp := &RespAdminCleanUser{
+		Bridges:   make(map[id.UserID]*RespQueueRooms),
+		Unmatched: []id.RoomID{},
+		Failed:    []id.RoomID{},
+	}
+	// jobs contains a job for each bridge bot found so far, so that the owner drained notifications
+	// aren't sent before all rooms of the bridge have been queued.
+	jobs := make(map[id.UserID]*CleanJob)
+	var respLock sync.Mutex
+	queue := make(chan id.RoomID)
+	var wg sync.WaitGroup
+	for i := 0; i < getThreadCount(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for roomID := range queue {
+				members, err := adminListRoomMembers(ctx, roomID)
+				botID := findRoomBridgeBot(req.UserID, members)
+				if err != nil {
+					reqLog.Warnfln("Failed to get members of %s: %v", roomID, err)
+					respLock.Lock()
+					resp.Failed = append(resp.Failed, roomID)
+					respLock.Unlock()
+					continue
+				} else if len(botID) == 0 {
+					reqLog.Debugfln("Not cleaning up %s as it doesn't have any bridge ghosts of %s", roomID, req.UserID)
+					respLock.Lock()
+					resp.Unmatched = append(resp.Unmatched, roomID)
+					respLock.Unlock()
+					continue
+				}
+				respLock.Lock()
+				bridgeResp, ok := resp.Bridges[botID]
+				if !ok {
+					bridgeResp = &RespQueueRooms{Queued: []id.RoomID{}, Failed: []id.RoomID{}, Rejected: []id.RoomID{}}
+					resp.Bridges[botID] = bridgeResp
+					_, jobs[botID] = startJob(ctx, botID, JobActionCleanUser)
+				}
+				respLock.Unlock()
+				queued, allowed := cleanUserRoom(ctx, req, adminKey, botID, roomID, dueTime)
+				respLock.Lock()
+				if !allowed {
+					bridgeResp.Rejected = append(bridgeResp.Rejected, roomID)
+				} else if !queued {
+					bridgeResp.Failed = append(bridgeResp.Failed, roomID)
+				} else {
+					bridgeResp.Queued = append(bridgeResp.Queued, roomID)
+				}
+				respLock.Unlock()
+			}
+		}()
+	}
+	for _, roomID := range rooms {
+		queue <- roomID
+	}
+	close(queue)
+	wg.Wait()
+	for botID, job := range jobs {
+		if bridgeResp := resp.Bridges[botID]; len(bridgeResp.Failed) == 0 && len(bridgeResp.Rejected) == 0 {
+			MarkOwnerFullCleanup(ctx, botID)
+		}
+		job.finish()
+	}
+	return resp, nil
+}
+
+func cleanUserRoom(ctx context.Context, req *ReqAdminCleanUser, adminKey *AdminAPIKey, botID id.UserID, roomID id.RoomID, dueTime time.Time) (queued, allowed bool) {
+	roomLog := roomLogger(logFromContext(ctx), roomID, botID, StageFilter)
+	ctx, span := startSpan(ctx, "queue_room", roomID, botID)
+	usersToKick, decision, err := IsAllowedToCleanRoom(ctx, bridgeBotClient(botID), roomID)
+	defer func() {
+		endSpan(span, err)
+	}()
+	observeStageError(botID, StageFilter, err)
+	if err != nil {
+		roomLog.Debugfln("Rejecting queuing of %s for deletion: %v", roomID, err)
+		WriteRequestAudit(ctx, AuditEntry{
+			Event:     AuditEventRejected,
+			RoomID:    roomID,
+			Owner:     botID,
+			Requester: "admin",
+			AdminKey:  adminKey.Name,
+			Decision:  err.Error(),
+		})
+		return false, false
+	}
+	err = PushLeaveQueue(ctx, &LeavingRoom{
+		RoomID:        roomID,
+		Owner:         botID,
+		Kick:          usersToKick,
+		DeleteOptions: req.DeleteOptions.OrNil(),
+		DueTime:       dueTime,
+	})
+	if err != nil {
+		roomLog.Warnfln("Failed to queue %s for deletion: %v", roomID, err)
+		return false, true
+	}
+	TrackOwnerRoom(ctx, botID)
+	roomLog.Debugfln("Queued %s for deletion as a room of %s", roomID, botID)
+	WriteRequestAudit(ctx, AuditEntry{
+		Event:     AuditEventQueued,
+		RoomID:    roomID,
+		Owner:     botID,
+		Requester: "admin",
+		AdminKey:  adminKey.Name,
+		Decision:  decision,
+	})
+	return true, true
+}
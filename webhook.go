@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"maunium.net/go/mautrix/id"
+)
+
+// WebhookEvent is the type of event sent to the configured webhooks.
+type WebhookEvent string
+
+const (
+	// WebhookCleanupAccepted is sent when a clean_all request is accepted.
+	WebhookCleanupAccepted WebhookEvent = "cleanup.accepted"
+	// WebhookOwnerDrained is sent when the last room of a bridge bot has left the leave and delete queues.
+	WebhookOwnerDrained WebhookEvent = "owner.drained"
+	// WebhookRoomErrored is sent when a room is pushed to the error queue.
+	WebhookRoomErrored WebhookEvent = "room.errored"
+	// WebhookErrorQueueThreshold is sent when the error queue length reaches WEBHOOK_ERROR_QUEUE_THRESHOLD.
+	WebhookErrorQueueThreshold WebhookEvent = "error_queue.threshold"
+	// WebhookGhostsDeactivated is sent when the ghosts of a bridge bot have been deactivated after its rooms were deleted.
+	WebhookGhostsDeactivated WebhookEvent = "ghosts.deactivated"
+)
+
+const (
+	webhookMaxAttempts    = 8
+	webhookInitialBackoff = 1 * time.Second
+	webhookMaxBackoff     = 5 * time.Minute
+	webhookTimeout        = 30 * time.Second
+)
+
+// WebhookPayload is the JSON body of webhook requests.
+type WebhookPayload struct {
+	Event      WebhookEvent `json:"event"`
+	DeliveryID string       `json:"delivery_id"`
+	Timestamp  int64        `json:"ts"`
+	DryRun     bool         `json:"dry_run"`
+
+	Owner            id.UserID     `json:"owner,omitempty"`
+	RoomID           id.RoomID     `json:"room_id,omitempty"`
+	Error            string        `json:"error,omitempty"`
+	ErrorQueueLength int64         `json:"error_queue_length,omitempty"`
+	Summary          *OwnerSummary `json:"summary,omitempty"`
+	Ghosts           *GhostReport  `json:"ghosts,omitempty"`
+}
+
+var webhookLog = newSubsystemLogger(SubsystemMain, "Webhook")
+
+var promWebhookCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "yeetserv_webhooks_total",
+		Help: "Number of webhook deliveries by event and final outcome",
+	},
+	[]string{"event", "outcome"},
+)
+
+// webhookSignature returns the value of the X-Yeetserv-Signature header for the given body.
+func webhookSignature(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SendWebhook sends the given event to all configured webhook URLs in the background.
+func SendWebhook(ctx context.Context, event WebhookEvent, payload WebhookPayload) {
+	if len(cfg.WebhookURLs) == 0 {
+		return
+	}
+	deliveryID := make([]byte, 16)
+	_, _ = rand.Read(deliveryID)
+	payload.Event = event
+	payload.DeliveryID = hex.EncodeToString(deliveryID)
+	payload.Timestamp = time.Now().UnixMilli()
+	payload.DryRun = isDryRunContext(ctx)
+	body, err := json.Marshal(&payload)
+	if err != nil {
+		webhookLog.Errorfln("Failed to marshal %s webhook: %v", event, err)
+		return
+	}
+	for _, url := range cfg.WebhookURLs {
+		go deliverWebhook(url, event, payload.DeliveryID, body)
+	}
+}
+
+// deliverWebhook sends a webhook request, retrying with exponential backoff on network errors, 429 and 5xx responses.
+func deliverWebhook(url string, event WebhookEvent, deliveryID string, body []byte) {
+	deliveryLog := webhookLog.With(LogFields{"webhook_event": event, "delivery_id": deliveryID})
+	backoff := webhookInitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := tryDeliverWebhook(url, event, deliveryID, body)
+		if err == nil {
+			deliveryLog.Debugfln("Delivered %s webhook to %s", event, url)
+			promWebhookCounter.WithLabelValues(string(event), string(OutcomeSuccess)).Inc()
+			return
+		} else if !retry || attempt >= webhookMaxAttempts {
+			deliveryLog.Errorfln("Failed to deliver %s webhook to %s after %d attempts: %v", event, url, attempt, err)
+			promWebhookCounter.WithLabelValues(string(event), string(OutcomeError)).Inc()
+			return
+		}
+		deliveryLog.Warnfln("Failed to deliver %s webhook to %s (attempt %d), retrying in %v: %v", event, url, attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func tryDeliverWebhook(url string, event WebhookEvent, deliveryID string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Yeetserv-Event", string(event))
+	req.Header.Set("X-Yeetserv-Delivery", deliveryID)
+	req.Header.Set("X-Yeetserv-Signature", webhookSignature(body))
+	client := *httpClient
+	client.Timeout = webhookTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}